@@ -15,9 +15,11 @@
 package main
 
 import (
+	"os"
+
 	"github.com/drzaeus77/go-chat-simple/server"
 )
 
 func main() {
-	server.Run()
+	os.Exit(server.RunCLI(os.Args[1:]))
 }
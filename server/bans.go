@@ -0,0 +1,140 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BanList is a set of banned user names and IP addresses, safe for
+// concurrent use. A list loaded from a file writes every change back to it,
+// so that bans survive a restart.
+type BanList struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]bool
+}
+
+// NewBanList returns an in-memory ban list holding entries.
+func NewBanList(entries ...string) *BanList {
+	l := &BanList{entries: make(map[string]bool)}
+	for _, e := range entries {
+		l.entries[e] = true
+	}
+	return l
+}
+
+// LoadBanList reads a ban list from path, one name or IP per line. Blank
+// lines and lines starting with '#' are ignored. A missing file yields an
+// empty list which will be created on the first Ban.
+func LoadBanList(path string) (*BanList, error) {
+	l := NewBanList()
+	l.path = path
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l.entries[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return l, nil
+}
+
+// Ban adds a name or IP to the list. If the list cannot be written back to
+// its file it is left unchanged.
+func (l *BanList) Ban(entry string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.copy()
+	next[entry] = true
+	return l.replace(next)
+}
+
+// Unban removes a name or IP from the list, leaving it unchanged if the file
+// cannot be written.
+func (l *BanList) Unban(entry string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	next := l.copy()
+	delete(next, entry)
+	return l.replace(next)
+}
+
+// copy returns a copy of the entries to be changed. Must be called with mu
+// held.
+func (l *BanList) copy() map[string]bool {
+	next := make(map[string]bool, len(l.entries)+1)
+	for e := range l.entries {
+		next[e] = true
+	}
+	return next
+}
+
+// replace saves entries and then makes them the list. Must be called with mu
+// held.
+func (l *BanList) replace(entries map[string]bool) error {
+	if err := l.save(entries); err != nil {
+		return err
+	}
+	l.entries = entries
+	return nil
+}
+
+// Banned reports whether either the user name or the IP is on the list. A nil
+// list bans nobody.
+func (l *BanList) Banned(name, ip string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.entries[name] || l.entries[ip]
+}
+
+// save rewrites the backing file, if any, to hold entries. Must be called
+// with mu held.
+func (l *BanList) save(set map[string]bool) error {
+	if l.path == "" {
+		return nil
+	}
+	var entries []string
+	for e := range set {
+		entries = append(entries, e)
+	}
+	sort.Strings(entries)
+	tmp := l.path + ".tmp"
+	data := strings.Join(entries, "\n") + "\n"
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
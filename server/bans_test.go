@@ -0,0 +1,93 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBanListFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans")
+	if err := os.WriteFile(path, []byte("# comment\nmallory\n\n10.0.0.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Banned("mallory", "") || !l.Banned("", "10.0.0.1") || l.Banned("alice", "10.0.0.2") {
+		t.Fatal("loaded list does not match the file")
+	}
+	if err := l.Ban("eve"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Unban("mallory"); err != nil {
+		t.Fatal(err)
+	}
+	l, err = LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !l.Banned("eve", "") || l.Banned("mallory", "") {
+		t.Error("changes were not saved")
+	}
+}
+
+func TestBanListSaveFailure(t *testing.T) {
+	l, err := LoadBanList(filepath.Join(t.TempDir(), "missing", "bans"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Ban("eve"); err == nil {
+		t.Fatal("Ban succeeded without a writable file")
+	}
+	if l.Banned("eve", "") {
+		t.Error("failed Ban changed the list")
+	}
+}
+
+func TestBanCommand(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Bans = NewBanList()
+	cfg.Operators = []string{"alice"}
+	b := startBoard(cfg)
+	// bob is the admin of the room, but the ban list is the server's.
+	admin := dial(t, b, "bob")
+	op := dial(t, b, "alice")
+
+	admin.send("/ban alice")
+	admin.expect("* " + ErrNotOperator.Error())
+	op.send("/ban mallory")
+	op.expect("* banned mallory")
+
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("mallory")
+	c.expect("you are banned")
+	c.closed()
+
+	op.send("/unban mallory")
+	op.expect("* unbanned mallory")
+	dial(t, b, "mallory")
+}
+
+func TestBanCommandNoList(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	c := dial(t, b, "alice")
+	c.send("/ban mallory")
+	c.expect("* " + ErrNoBanList.Error())
+}
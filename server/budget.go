@@ -0,0 +1,158 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "sync"
+
+// historyBudget caps the memory used by the history of every board in a
+// registry together. Once the total goes over the limit the oldest messages
+// are evicted first, whichever board they belong to.
+//
+// Boards only look after their own history, so an eviction is a request:
+// the owner is told how far to trim and does so on its own goroutine. The
+// budget never waits on a board, which keeps boards from waiting on each
+// other.
+type historyBudget struct {
+	limit int
+
+	mu   sync.Mutex
+	used int
+	// queue holds every message counted against the budget, oldest first,
+	// and entries finds them again.
+	queue   []*budgetEntry
+	entries map[budgetKey]*budgetEntry
+	// gone counts the entries in queue that no longer count. They are
+	// cleared out once they make up half of it, so that a board that
+	// drops messages by itself does not grow the queue for ever.
+	gone int
+}
+
+type budgetKey struct {
+	b   *Board
+	seq uint64
+}
+
+type budgetEntry struct {
+	budgetKey
+	size int
+	// gone is set once the message no longer counts.
+	gone bool
+}
+
+func newHistoryBudget(limit int) *historyBudget {
+	return &historyBudget{
+		limit:   limit,
+		entries: make(map[budgetKey]*budgetEntry),
+	}
+}
+
+// messageSize is what a message in the history counts for.
+func messageSize(m Message) int {
+	return len(m.Name) + len(m.Msg)
+}
+
+// add counts m, kept by b, and evicts the oldest messages until the total is
+// back within the limit. Called by b's goroutine.
+func (h *historyBudget) add(b *Board, m Message) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := &budgetEntry{budgetKey: budgetKey{b, m.Seq}, size: messageSize(m)}
+	h.queue = append(h.queue, e)
+	h.entries[e.budgetKey] = e
+	h.used += e.size
+	for h.used > h.limit && len(h.queue) > 0 {
+		if e := h.queue[0]; !e.gone {
+			h.forget(e)
+			e.b.evictThrough(e.seq)
+		}
+		h.tidy()
+	}
+}
+
+// drop stops counting the message b kept as seq, which b has let go of by
+// itself.
+func (h *historyBudget) drop(b *Board, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if e := h.entries[budgetKey{b, seq}]; e != nil {
+		h.forget(e)
+		h.tidy()
+	}
+}
+
+// dropBoard stops counting anything kept by b, which is going away.
+func (h *historyBudget) dropBoard(b *Board) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.queue {
+		if e.b == b && !e.gone {
+			h.forget(e)
+		}
+	}
+	h.tidy()
+}
+
+func (h *historyBudget) forget(e *budgetEntry) {
+	e.gone = true
+	h.gone++
+	h.used -= e.size
+	delete(h.entries, e.budgetKey)
+}
+
+// tidy takes the entries that no longer count off the front of the queue,
+// and out of the rest of it once there are enough of them.
+func (h *historyBudget) tidy() {
+	for len(h.queue) > 0 && h.queue[0].gone {
+		h.queue[0] = nil
+		h.queue = h.queue[1:]
+		h.gone--
+	}
+	if h.gone <= len(h.queue)/2 {
+		return
+	}
+	live := make([]*budgetEntry, 0, len(h.queue)-h.gone)
+	for _, e := range h.queue {
+		if !e.gone {
+			live = append(live, e)
+		}
+	}
+	h.queue, h.gone = live, 0
+}
+
+// evictThrough asks the board to drop every message in its history up to
+// and including seq. Safe to call from any goroutine.
+func (b *Board) evictThrough(seq uint64) {
+	for {
+		old := b.evictTo.Load()
+		if old >= seq || b.evictTo.CompareAndSwap(old, seq) {
+			break
+		}
+	}
+	select {
+	case b.evictCh <- struct{}{}:
+	default:
+	}
+}
+
+// evict drops whatever the history budget asked for. Runs on the board
+// goroutine.
+func (b *Board) evict() {
+	to := b.evictTo.Load()
+	n := 0
+	for n < len(b.history) && b.history[n].Seq <= to {
+		n++
+	}
+	b.history = b.history[n:]
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func historyOf(b *Board) string {
+	var msgs []string
+	for _, m := range b.Snapshot().History {
+		msgs = append(msgs, m.Msg)
+	}
+	return fmt.Sprint(msgs)
+}
+
+func TestHistoryBudget(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistorySize = 10
+	// Room for three messages of 11 bytes from "al".
+	cfg.HistoryBudget = 36
+	boards := NewBoardRegistry(cfg)
+	a := boards.GetOrCreate("a")
+	b := boards.GetOrCreate("b")
+
+	a.Publish("al", "a-one....")
+	a.Publish("al", "a-two....")
+	a.sync()
+	b.Publish("al", "b-one....")
+	b.sync()
+	if got := historyOf(a); got != "[a-one.... a-two....]" {
+		t.Errorf("a kept %s before the budget ran out", got)
+	}
+	// The oldest message overall goes, though it is on another board.
+	b.Publish("al", "b-two....")
+	b.sync()
+	if got := historyOf(a); got != "[a-two....]" {
+		t.Errorf("a kept %s", got)
+	}
+	if got := historyOf(b); got != "[b-one.... b-two....]" {
+		t.Errorf("b kept %s", got)
+	}
+	a.Publish("al", "a-three..")
+	a.sync()
+	if got := historyOf(a); got != "[a-three..]" {
+		t.Errorf("a kept %s", got)
+	}
+	b.Publish("al", "b-three..")
+	b.sync()
+	if got := historyOf(b); got != "[b-two.... b-three..]" {
+		t.Errorf("b kept %s", got)
+	}
+}
+
+func TestHistoryBudgetWithHistorySize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistorySize = 1
+	cfg.HistoryBudget = 36
+	boards := NewBoardRegistry(cfg)
+	a := boards.GetOrCreate("a")
+	b := boards.GetOrCreate("b")
+	// What a drops on its own no longer counts, so b keeps everything it
+	// can.
+	for i := 0; i < 5; i++ {
+		a.Publish("al", fmt.Sprintf("a-%d......", i))
+	}
+	a.sync()
+	b.Publish("al", "b-one....")
+	b.sync()
+	if got := historyOf(a); got != "[a-4......]" {
+		t.Errorf("a kept %s", got)
+	}
+	if got := historyOf(b); got != "[b-one....]" {
+		t.Errorf("b kept %s", got)
+	}
+	// Closing a board gives back its share.
+	a.Close()
+	c := boards.GetOrCreate("c")
+	c.Publish("al", "c-one....")
+	c.sync()
+	if got := historyOf(b); got != "[b-one....]" {
+		t.Errorf("b kept %s after a closed", got)
+	}
+}
+
+func TestHistoryBudgetQueueBounded(t *testing.T) {
+	keep := 10
+	cfg := DefaultConfig()
+	cfg.HistorySize = 1
+	cfg.HistoryBudget = 1 << 20
+	cfg.Rooms = map[string]RoomConfig{"b": {HistorySize: &keep}}
+	boards := NewBoardRegistry(cfg)
+	a := boards.GetOrCreate("a")
+	b := boards.GetOrCreate("b")
+	// b's message stays at the front of the queue while a keeps dropping
+	// its own, well within the budget.
+	b.Publish("al", "b-one")
+	b.sync()
+	for i := 0; i < 1000; i++ {
+		a.Publish("al", fmt.Sprintf("a-%d", i))
+	}
+	a.sync()
+	h := boards.budget
+	h.mu.Lock()
+	n, used := len(h.queue), h.used
+	h.mu.Unlock()
+	if n > 4 {
+		t.Errorf("queue holds %d entries for 2 messages", n)
+	}
+	if want := len("al")*2 + len("b-one") + len("a-999"); used != want {
+		t.Errorf("used %d, want %d", used, want)
+	}
+}
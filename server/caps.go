@@ -0,0 +1,51 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+)
+
+// A client may tell the server what it can do by answering a login prompt
+// with "CAPS" and a list of features, e.g. "CAPS color json threading
+// typing", after which it is prompted again. Notifications for a feature are
+// only sent to clients that listed it; so far that is typing, for TYPING, and
+// welcome, for a "you are <name>" notice once the login has succeeded. A
+// client listing crlf is sent lines ending in "\r\n" from then on.
+const capsPrefix = "CAPS"
+
+// capabilities holds the features a connection advertised.
+type capabilities map[string]bool
+
+// parseCapabilities reports whether line advertises capabilities, and which.
+func parseCapabilities(line string) (capabilities, bool) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != capsPrefix {
+		return nil, false
+	}
+	caps := make(capabilities)
+	for _, f := range fields[1:] {
+		caps[strings.ToLower(f)] = true
+	}
+	return caps, true
+}
+
+// wants reports whether a connection with caps should be sent n.
+func (caps capabilities) wants(n *Notification) bool {
+	if n.Type == TYPING {
+		return caps["typing"]
+	}
+	return true
+}
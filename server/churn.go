@@ -0,0 +1,110 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// churnSweep is how many connections the churn guard sees between sweeps of
+// the sources it no longer needs to remember.
+const churnSweep = 1024
+
+// churnGuard spots sources that connect over and over in a short time, and
+// holds them off for a cooldown. It is only used by the accept loop, so it
+// needs no locking.
+type churnGuard struct {
+	limit    int
+	window   time.Duration
+	cooldown time.Duration
+	sources  map[string]*churnSource
+	seen     int
+}
+
+type churnSource struct {
+	// recent holds when the source last connected, oldest first, within
+	// the window.
+	recent []time.Time
+	// until is when a cooldown is over.
+	until time.Time
+}
+
+// newChurnGuard returns the guard configured by cfg, or nil if reconnects
+// are not limited.
+func newChurnGuard(cfg Config) *churnGuard {
+	if cfg.ReconnectLimit <= 0 || cfg.ReconnectWindow <= 0 || cfg.ReconnectCooldown <= 0 {
+		return nil
+	}
+	return &churnGuard{
+		limit:    cfg.ReconnectLimit,
+		window:   cfg.ReconnectWindow,
+		cooldown: cfg.ReconnectCooldown,
+		sources:  make(map[string]*churnSource),
+	}
+}
+
+// source returns the part of addr that identifies where a connection came
+// from: its IP, or all of it if it has no port.
+func source(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// allow records a connection from src at now. If src is cooling down, or
+// this connection takes it past the limit, it reports false along with how
+// long the cooldown has left to run.
+func (g *churnGuard) allow(src string, now time.Time) (bool, time.Duration) {
+	if g.seen++; g.seen%churnSweep == 0 {
+		g.sweep(now)
+	}
+	s := g.sources[src]
+	if s == nil {
+		s = &churnSource{}
+		g.sources[src] = s
+	}
+	if now.Before(s.until) {
+		return false, s.until.Sub(now)
+	}
+	s.recent = append(trimBefore(s.recent, now.Add(-g.window)), now)
+	if len(s.recent) > g.limit {
+		fmt.Printf("[%s] is reconnecting too often, cooling down for %s\n", src, g.cooldown)
+		s.recent = nil
+		s.until = now.Add(g.cooldown)
+		return false, g.cooldown
+	}
+	return true, 0
+}
+
+// sweep forgets the sources with nothing left to remember.
+func (g *churnGuard) sweep(now time.Time) {
+	for src, s := range g.sources {
+		if s.recent = trimBefore(s.recent, now.Add(-g.window)); len(s.recent) == 0 && !now.Before(s.until) {
+			delete(g.sources, src)
+		}
+	}
+}
+
+// trimBefore drops the times in ts, oldest first, that are not after t.
+func trimBefore(ts []time.Time, t time.Time) []time.Time {
+	i := 0
+	for i < len(ts) && !ts[i].After(t) {
+		i++
+	}
+	return ts[i:]
+}
@@ -0,0 +1,179 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RunCLI parses command line arguments into a Config and runs the server.
+// It returns the process exit code.
+func RunCLI(args []string) int {
+	cfg, err := parseFlags(args)
+	if err == flag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := Run(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// parseFlags builds a Config from the defaults, then the -config file if
+// given, then any flags set explicitly.
+func parseFlags(args []string) (Config, error) {
+	cfg := DefaultConfig()
+	fs := flag.NewFlagSet("chat-daemon", flag.ContinueOnError)
+	configFile := fs.String("config", "", "JSON `file` to read settings from")
+	addr := fs.String("addr", cfg.Addr, "TCP `address` to listen on")
+	maxClients := fs.Int("max-clients", cfg.MaxClients, "maximum clients per room, 0 for no limit")
+	history := fs.Int("history", cfg.HistorySize, "number of messages replayed to joiners")
+	idle := fs.Duration("idle-timeout", cfg.IdleTimeout, "disconnect clients idle for this long, 0 to disable")
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if *configFile != "" {
+		if err := LoadConfigFile(*configFile, &cfg); err != nil {
+			return cfg, err
+		}
+	}
+	// Flags given on the command line win over the file.
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			cfg.Addr = *addr
+		case "max-clients":
+			cfg.MaxClients = *maxClients
+		case "history":
+			cfg.HistorySize = *history
+		case "idle-timeout":
+			cfg.IdleTimeout = *idle
+		}
+	})
+	return cfg, nil
+}
+
+// duration is a time.Duration written as a string such as "90s" in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type roomFile struct {
+	MaxClients      *int    `json:"max_clients"`
+	History         *int    `json:"history"`
+	MessageTemplate *string `json:"message_template"`
+}
+
+type configFile struct {
+	Addr            *string             `json:"addr"`
+	MaxClients      *int                `json:"max_clients"`
+	MaxConnections  *int                `json:"max_connections"`
+	History         *int                `json:"history"`
+	IdleTimeout     *duration           `json:"idle_timeout"`
+	MotdFile        *string             `json:"motd_file"`
+	BanFile         *string             `json:"ban_file"`
+	MessageTemplate *string             `json:"message_template"`
+	Rooms           map[string]roomFile `json:"rooms"`
+}
+
+// LoadConfigFile applies the settings in a JSON file to cfg. Settings absent
+// from the file are left as they are. For example:
+//
+//	{
+//		"addr": ":5001",
+//		"max_clients": 50,
+//		"history": 20,
+//		"idle_timeout": "10m",
+//		"rooms": {"lobby": {"max_clients": 200, "message_template": "{{.Name}}> {{.Msg}}"}}
+//	}
+func LoadConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var f configFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	if f.Addr != nil {
+		cfg.Addr = *f.Addr
+	}
+	if f.MaxClients != nil {
+		cfg.MaxClients = *f.MaxClients
+	}
+	if f.MaxConnections != nil {
+		cfg.MaxConnections = *f.MaxConnections
+	}
+	if f.History != nil {
+		cfg.HistorySize = *f.History
+	}
+	if f.IdleTimeout != nil {
+		cfg.IdleTimeout = time.Duration(*f.IdleTimeout)
+	}
+	if f.MotdFile != nil {
+		cfg.MotdFile = *f.MotdFile
+	}
+	if f.MessageTemplate != nil {
+		if _, err := parseMessageTemplate(*f.MessageTemplate); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		cfg.MessageTemplate = *f.MessageTemplate
+	}
+	if f.BanFile != nil {
+		if cfg.Bans, err = LoadBanList(*f.BanFile); err != nil {
+			return err
+		}
+	}
+	if len(f.Rooms) > 0 && cfg.Rooms == nil {
+		cfg.Rooms = make(map[string]RoomConfig)
+	}
+	for name, r := range f.Rooms {
+		room := cfg.Rooms[name]
+		if r.MaxClients != nil {
+			room.MaxClients = r.MaxClients
+		}
+		if r.History != nil {
+			room.HistorySize = r.History
+		}
+		if r.MessageTemplate != nil {
+			if _, err := parseMessageTemplate(*r.MessageTemplate); err != nil {
+				return fmt.Errorf("%s: room %s: %s", path, name, err)
+			}
+			room.MessageTemplate = r.MessageTemplate
+		}
+		cfg.Rooms[name] = room
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{
+		"addr": ":6000",
+		"max_clients": 50,
+		"history": 20,
+		"idle_timeout": "10m",
+		"rooms": {"lobby": {"max_clients": 0}}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseFlags([]string{"-config", path, "-history", "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != ":6000" || cfg.MaxClients != 50 || cfg.IdleTimeout != 10*time.Minute {
+		t.Errorf("file settings not applied: %+v", cfg)
+	}
+	// Flags win over the file.
+	if cfg.HistorySize != 5 {
+		t.Errorf("history is %d, want the flag's 5", cfg.HistorySize)
+	}
+	if m := cfg.Rooms["lobby"].MaxClients; m == nil || *m != 0 {
+		t.Errorf("lobby override is %v, want 0", m)
+	}
+	if lobby := cfg.ForRoom("lobby"); lobby.MaxClients != 0 {
+		t.Errorf("lobby has max clients %d, want 0", lobby.MaxClients)
+	}
+}
+
+func TestParseFlagsDefaults(t *testing.T) {
+	cfg, err := parseFlags(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Addr != DefaultConfig().Addr {
+		t.Errorf("addr is %q", cfg.Addr)
+	}
+	if _, err := parseFlags([]string{"-config", filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("missing config file was not an error")
+	}
+	if _, err := parseFlags([]string{"-bogus"}); err == nil {
+		t.Error("unknown flag was not an error")
+	}
+}
+
+func TestLoadMessageTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := `{"rooms": {"fancy": {"message_template": "{{.Name}}> {{.Msg}}"}}}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	if err := LoadConfigFile(path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if tmpl := cfg.ForRoom("fancy").MessageTemplate; tmpl != "{{.Name}}> {{.Msg}}" {
+		t.Errorf("fancy has template %q", tmpl)
+	}
+
+	for _, data := range []string{
+		`{"message_template": "{{.Name"}`,
+		`{"rooms": {"fancy": {"message_template": "{{if}}"}}}`,
+	} {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadConfigFile(path, &cfg); err == nil {
+			t.Errorf("%s loaded", data)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// Client is an in-process participant on a board, for bots and tests that
+// want to chat without a network connection. Messages for the client arrive
+// on C until Close. C is buffered by SendQueueSize like any other client's
+// queue; with the default of zero the board waits on every send to C, so C
+// must be read promptly until Close.
+type Client struct {
+	Name string
+	C    <-chan *Notification
+
+	b  *Board
+	ch chan *Notification
+}
+
+// Connect logs name in to b as an in-process client.
+func Connect(b *Board, name string) (*Client, error) {
+	ch := make(chan *Notification, b.cfg.SendQueueSize)
+	if err := b.Login(name, ch); err != nil {
+		return nil, err
+	}
+	return &Client{
+		Name: name,
+		C:    ch,
+		b:    b,
+		ch:   ch,
+	}, nil
+}
+
+// Send publishes msg to the board. It fails as Publish does, if the board is
+// closed or not started.
+func (c *Client) Send(msg string) error {
+	return c.b.Publish(c.Name, msg)
+}
+
+// SendLines publishes each line in order, as if by Send. Long lines are
+// fragmented and limits are applied exactly as for a single Send. It stops
+// at the first line that cannot be sent.
+func (c *Client) SendLines(lines []string) error {
+	for _, line := range lines {
+		if err := c.Send(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close logs the client out and closes C. Anything still unread on C is
+// discarded.
+func (c *Client) Close() {
+	// The board may be waiting to send to us, in which case it cannot take
+	// the logout until ch has room.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range c.ch {
+		}
+	}()
+	c.b.Logout(c.Name)
+	// The board has taken the logout, so it will not send to ch again.
+	close(c.ch)
+	<-done
+}
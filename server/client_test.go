@@ -0,0 +1,136 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientSendLines(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FragmentSize = 4
+	b := startBoard(cfg)
+	bot, err := Connect(b, "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+	sub := make(chan *Notification, 10)
+	b.Login("sub", sub)
+
+	if err := bot.SendLines([]string{"one", "two", "three"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one", "two", "thre", "e"} {
+		if n := recv(t, sub); n.Name != "bot" || n.Msg != want {
+			t.Errorf("got %+v, want %q", n, want)
+		}
+	}
+
+	b.Close()
+	if err := bot.Send("too late"); err != ErrBoardClosed {
+		t.Errorf("send to a closed board got %v", err)
+	}
+	if err := bot.SendLines([]string{"too", "late"}); err != ErrBoardClosed {
+		t.Errorf("lines to a closed board got %v", err)
+	}
+}
+
+func TestClientCloseUnread(t *testing.T) {
+	// With no send queue the board blocks on a client that is not reading.
+	b := startBoard(DefaultConfig())
+	c, err := Connect(b, "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Publish("alice", "never read")
+	c.Close()
+	if _, err := Connect(b, "bot"); err != nil {
+		t.Errorf("name still taken after Close: %v", err)
+	}
+}
+
+// trackingListener passes on every connection it accepts.
+type trackingListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.conns <- conn
+	}
+	return conn, err
+}
+
+func TestNetClientReconnects(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Events = NewEventStream(100, true)
+	b := startBoard(cfg)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tl := trackingListener{l, make(chan net.Conn, 10)}
+	go accept(tl, b, cfg)
+	loggedIn := func() {
+		t.Helper()
+		for {
+			select {
+			case e := <-cfg.Events.C:
+				if e.Type == EventLogin && e.Name == "bot" {
+					return
+				}
+			case <-time.After(testTimeout):
+				t.Fatal("bot did not log in")
+			}
+		}
+	}
+
+	bot, err := DialClient(l.Addr().String(), "bot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bot.Close()
+	loggedIn()
+	b.Publish("alice", "one")
+	if n := recv(t, bot.C); n.Type != TEXTLINE || n.Name != "alice" || n.Msg != "one" {
+		t.Errorf("got %+v", n)
+	}
+
+	// Kill the connection from the server end.
+	(<-tl.conns).Close()
+	loggedIn()
+	b.Publish("alice", "two")
+	if n := recv(t, bot.C); n.Msg != "two" {
+		t.Errorf("got %+v after reconnecting", n)
+	}
+	alice := make(chan *Notification, 10)
+	b.Login("alice", alice)
+	if err := bot.Send("still here"); err != nil {
+		t.Fatal(err)
+	}
+	if n := recv(t, alice); n.Name != "bot" || n.Msg != "still here" {
+		t.Errorf("alice got %+v", n)
+	}
+
+	if _, err := DialClient(l.Addr().String(), "bot"); err == nil || err.Error() != ErrNameTaken.Error() {
+		t.Errorf("second bot got %v, want %v", err, ErrNameTaken)
+	}
+}
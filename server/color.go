@@ -0,0 +1,39 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+)
+
+// namePalette is the ANSI foreground colors names are drawn in: red, green,
+// yellow, blue, magenta and cyan, in normal and bright. Black and white are
+// left out as they vanish on one terminal background or the other.
+var namePalette = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// ColorForName returns the ANSI SGR foreground color code, such as 31 for
+// red, that the server uses for name. The choice depends only on the name,
+// so clients can match the server's colors.
+func ColorForName(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return namePalette[h.Sum32()%uint32(len(namePalette))]
+}
+
+// colorName wraps name in the escape sequences for its color.
+func colorName(name string) string {
+	return fmt.Sprintf("\x1b[%dm%s\x1b[0m", ColorForName(name), name)
+}
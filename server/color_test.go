@@ -0,0 +1,49 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestColorForName(t *testing.T) {
+	if a, b := ColorForName("alice"), ColorForName("alice"); a != b {
+		t.Fatalf("alice got %d then %d", a, b)
+	}
+	counts := make(map[int]int)
+	const names = 1200
+	for i := 0; i < names; i++ {
+		counts[ColorForName(fmt.Sprint("user", i))]++
+	}
+	if len(counts) != len(namePalette) {
+		t.Errorf("only %d of %d colors used", len(counts), len(namePalette))
+	}
+	// Each color should get about names/len(namePalette) = 100.
+	for c, n := range counts {
+		if n < 50 || n > 150 {
+			t.Errorf("color %d used %d times", c, n)
+		}
+	}
+}
+
+func TestColorNames(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ColorNames = true
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+	b.Publish("bob", "hi")
+	c.expect(fmt.Sprintf("\x1b[%dmbob\x1b[0m: hi", ColorForName("bob")))
+}
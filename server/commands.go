@@ -0,0 +1,545 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandFunc handles a slash command. An error it returns is shown to the
+// client that typed the command.
+type CommandFunc func(ctx CommandContext) error
+
+// CommandContext is what a CommandFunc is given: who typed the command, on
+// which board, and a way to answer them.
+type CommandContext struct {
+	// Name is the client that typed the command, as logged in to Board.
+	Name  string
+	Board *Board
+	// Command is the command as typed, such as "/topic", and Arg the rest
+	// of the line with the spaces around it trimmed.
+	Command string
+	Arg     string
+
+	// reply is the client's queue, and p and st its session, for the
+	// commands that change the session itself.
+	reply chan *Notification
+	p     protocol
+	st    *seat
+	cmds  *CommandRegistry
+}
+
+// Reply sends msg to the client that typed the command, and nobody else.
+func (ctx CommandContext) Reply(msg string) {
+	ctx.reply <- notice(msg)
+}
+
+// CommandRegistry holds the slash commands clients can type, by name. Set
+// one as Config.Commands to add commands of your own to the built-in ones.
+// /quit is always handled by Serve itself.
+type CommandRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]CommandFunc
+	// names lists the commands in the order they were first registered,
+	// for /help.
+	names []string
+}
+
+// builtins serves any Config without Commands of its own.
+var builtins = NewCommandRegistry()
+
+// commands returns the configured CommandRegistry, falling back to the
+// built-in commands.
+func (c *Config) commands() *CommandRegistry {
+	if c.Commands == nil {
+		return builtins
+	}
+	return c.Commands
+}
+
+// Register makes fn the handler for the command name, which includes the
+// leading slash, as in "/roll". It replaces any handler already registered
+// under name, built-in ones included, which keeps its place in /help. It is
+// safe to call while clients are connected.
+func (r *CommandRegistry) Register(name string, fn CommandFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.handlers[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.handlers[name] = fn
+}
+
+// Names lists the registered commands in the order they were first
+// registered.
+func (r *CommandRegistry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.names...)
+}
+
+func (r *CommandRegistry) lookup(name string) CommandFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.handlers[name]
+}
+
+// command runs a slash command typed by the client logged in as name, whose
+// session is p and st. Output meant only for that client is sent on reply.
+// Returns false if line is not a known command, which the caller deals with.
+func command(b *Board, name, line string, p protocol, st *seat, reply chan *Notification) bool {
+	cmds := b.cfg.commands()
+	cmd, arg := splitCommand(line)
+	fn := cmds.lookup(cmd)
+	if fn == nil {
+		return false
+	}
+	ctx := CommandContext{Name: name, Board: b, Command: cmd, Arg: arg, reply: reply, p: p, st: st, cmds: cmds}
+	if err := fn(ctx); err != nil {
+		ctx.Reply(err.Error())
+	}
+	return true
+}
+
+// NewCommandRegistry returns a registry holding the built-in commands, to
+// which more can be added.
+func NewCommandRegistry() *CommandRegistry {
+	cmds := &CommandRegistry{handlers: make(map[string]CommandFunc)}
+	lock := func(ctx CommandContext) error {
+		return ctx.Board.Lock(ctx.Name, ctx.Command == "/lock")
+	}
+	ban := func(ctx CommandContext) error {
+		var err error
+		switch {
+		case ctx.Arg == "":
+			ctx.Reply("usage: " + ctx.Command + " <name or ip>")
+			return nil
+		case ctx.Command == "/ban":
+			err = ctx.Board.Ban(ctx.Name, ctx.Arg)
+		default:
+			err = ctx.Board.Unban(ctx.Name, ctx.Arg)
+		}
+		if err != nil {
+			return err
+		}
+		ctx.Reply(ctx.Command[1:] + "ned " + ctx.Arg)
+		return nil
+	}
+	watch := func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			ctx.Reply("usage: " + ctx.Command + " <name>")
+		} else if ctx.Command == "/watch" {
+			ctx.Board.Watch(ctx.Name, ctx.Arg)
+			ctx.Reply("watching " + ctx.Arg)
+		} else {
+			ctx.Board.Unwatch(ctx.Name, ctx.Arg)
+			ctx.Reply("no longer watching " + ctx.Arg)
+		}
+		return nil
+	}
+	pin := func(ctx CommandContext) error {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(ctx.Arg, "#"), 10, 64)
+		if err != nil {
+			ctx.Reply("usage: " + ctx.Command + " <msgid>")
+			return nil
+		}
+		return ctx.Board.Pin(ctx.Name, seq, ctx.Command == "/pin")
+	}
+	cmds.Register("/help", func(ctx CommandContext) error {
+		ctx.Reply("commands: /quit " + strings.Join(ctx.cmds.Names(), " "))
+		return nil
+	})
+	cmds.Register("/format", func(ctx CommandContext) error {
+		ctx.reply <- setFormat(ctx.p, ctx.Arg)
+		return nil
+	})
+	cmds.Register("/join", func(ctx CommandContext) error {
+		ctx.Reply(ctx.st.join(ctx.Arg, ctx.reply))
+		return nil
+	})
+	cmds.Register("/motd", func(ctx CommandContext) error {
+		for _, l := range ctx.Board.motd() {
+			ctx.Reply(l)
+		}
+		return nil
+	})
+	cmds.Register("/seen", func(ctx CommandContext) error {
+		ctx.Reply(ctx.Board.seen(ctx.Arg))
+		return nil
+	})
+	cmds.Register("/topic", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			if topic := ctx.Board.Topic(); topic != "" {
+				ctx.Reply("topic: " + topic)
+			} else {
+				ctx.Reply("no topic is set")
+			}
+			return nil
+		}
+		return ctx.Board.SetTopic(ctx.Name, ctx.Arg)
+	})
+	cmds.Register("/slowmode", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			if d := ctx.Board.SlowMode(); d > 0 {
+				ctx.Reply(fmt.Sprintf("slow mode: one message per %s", d))
+			} else {
+				ctx.Reply("slow mode is off")
+			}
+			return nil
+		}
+		secs, err := strconv.Atoi(ctx.Arg)
+		if err != nil || secs < 0 {
+			ctx.Reply("usage: /slowmode [seconds]")
+			return nil
+		}
+		return ctx.Board.SetSlowMode(ctx.Name, time.Duration(secs)*time.Second)
+	})
+	cmds.Register("/grant", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			ctx.Reply("usage: /grant <name>")
+			return nil
+		}
+		return ctx.Board.Grant(ctx.Name, ctx.Arg)
+	})
+	cmds.Register("/ban", ban)
+	cmds.Register("/unban", ban)
+	cmds.Register("/watch", watch)
+	cmds.Register("/unwatch", watch)
+	cmds.Register("/report", func(ctx CommandContext) error {
+		target, reason := splitCommand(ctx.Arg)
+		if target == "" || reason == "" {
+			ctx.Reply("usage: /report <name> <reason>")
+			return nil
+		}
+		if err := ctx.Board.Report(ctx.Name, target, reason); err != nil {
+			return err
+		}
+		ctx.Reply("report sent to the room admin")
+		return nil
+	})
+	cmds.Register("/msg", func(ctx CommandContext) error {
+		var receipt chan struct{}
+		if to, rest := splitCommand(ctx.Arg); to == "-r" {
+			receipt = make(chan struct{})
+			ctx.Arg = rest
+		}
+		to, text := splitCommand(ctx.Arg)
+		if to == "" || text == "" {
+			ctx.Reply("usage: /msg [-r] <name> <text>")
+		} else if err := ctx.Board.Direct(ctx.Name, to, text, receipt); err == ErrNoSuchUser {
+			ctx.Reply(to + " is not here, not delivered")
+		} else if err != nil {
+			ctx.Reply(err.Error())
+		} else if receipt != nil {
+			ctx.Reply(ctx.Board.awaitReceipt(to, receipt))
+		}
+		return nil
+	})
+	cmds.Register("/recent", func(ctx CommandContext) error {
+		recent := ctx.Board.Recent()
+		if len(recent) == 0 {
+			ctx.Reply("nobody has come or gone yet")
+		}
+		for _, m := range recent {
+			what := "left"
+			if m.Joined {
+				what = "joined"
+			}
+			ctx.Reply(fmt.Sprintf("%s %s %s", m.Time.Format("15:04:05"), m.Name, what))
+		}
+		return nil
+	})
+	cmds.Register("/who", func(ctx CommandContext) error {
+		ctx.Reply("here: " + strings.Join(ctx.Board.Who(), ", "))
+		return nil
+	})
+	cmds.Register("/away", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			ctx.Reply("usage: /away <message>")
+			return nil
+		}
+		if err := ctx.Board.SetAway(ctx.Name, ctx.Arg); err != nil {
+			return err
+		}
+		ctx.Reply("you are away: " + ctx.Arg)
+		return nil
+	})
+	cmds.Register("/back", func(ctx CommandContext) error {
+		if err := ctx.Board.SetAway(ctx.Name, ""); err != nil {
+			return err
+		}
+		ctx.Reply("welcome back")
+		return nil
+	})
+	cmds.Register("/reply", func(ctx CommandContext) error {
+		id, text := splitCommand(ctx.Arg)
+		parent, err := strconv.ParseUint(strings.TrimPrefix(id, "#"), 10, 64)
+		if err != nil || parent == 0 || text == "" {
+			ctx.Reply("usage: /reply <msgid> <text>")
+			return nil
+		}
+		var ackCh chan<- *Notification
+		if ctx.Board.cfg.Ack != AckNone {
+			ackCh = ctx.reply
+		}
+		ctx.Board.Reply(ctx.Name, parent, text, ackCh)
+		return nil
+	})
+	cmds.Register("/myrooms", func(ctx CommandContext) error {
+		rooms := []string{ctx.Board.Name}
+		if ctx.Board.rooms != nil {
+			rooms = ctx.Board.rooms.RoomsOf(ctx.Name)
+		}
+		ctx.Reply("your rooms: " + strings.Join(rooms, ", "))
+		return nil
+	})
+	cmds.Register("/redact", func(ctx CommandContext) error {
+		seq, err := strconv.ParseUint(strings.TrimPrefix(ctx.Arg, "#"), 10, 64)
+		if err != nil {
+			ctx.Reply("usage: /redact <msgid>")
+			return nil
+		}
+		return ctx.Board.Redact(ctx.Name, seq)
+	})
+	cmds.Register("/create", func(ctx CommandContext) error {
+		switch {
+		case ctx.Board.rooms == nil:
+			ctx.Reply("this server has only the one room")
+		case ctx.Arg == "":
+			ctx.Reply("usage: /create <room>")
+		case !ctx.Board.cfg.isOperator(ctx.Name):
+			ctx.Reply(ErrNotOperator.Error())
+		default:
+			if err := ctx.Board.rooms.Create(ctx.Arg); err != nil {
+				ctx.Reply(fmt.Sprintf("cannot create %s: %s", ctx.Arg, err))
+			} else {
+				ctx.Reply("created " + ctx.Arg + ", /join " + ctx.Arg + " to go there")
+			}
+		}
+		return nil
+	})
+	cmds.Register("/transcript", func(ctx CommandContext) error {
+		if !ctx.Board.cfg.isOperator(ctx.Name) {
+			return ErrNotOperator
+		}
+		if ctx.Arg == "" {
+			ctx.Arg = "plain"
+		}
+		var out strings.Builder
+		if err := ctx.Board.WriteTranscript(&out, ctx.Arg); err != nil {
+			ctx.Reply(err.Error())
+			return nil
+		}
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		if out.Len() == 0 {
+			lines = nil
+		}
+		ctx.Reply(fmt.Sprintf("transcript of %s, %d messages:", ctx.Board.Name, len(lines)))
+		for _, l := range lines {
+			ctx.Reply(l)
+		}
+		return nil
+	})
+	cmds.Register("/typing", func(ctx CommandContext) error {
+		ctx.Board.Typing(ctx.Name)
+		return nil
+	})
+	cmds.Register("/clearhistory", func(ctx CommandContext) error {
+		return ctx.Board.ClearHistory(ctx.Name)
+	})
+	cmds.Register("/role", func(ctx CommandContext) error {
+		target, role := splitCommand(ctx.Arg)
+		var r Role
+		switch role {
+		case "regular":
+			r = RoleRegular
+		case "spectator":
+			r = RoleSpectator
+		default:
+			ctx.Reply("usage: /role <name> regular|spectator")
+			return nil
+		}
+		if err := ctx.Board.SetRole(ctx.Name, target, r); err != nil {
+			return err
+		}
+		ctx.Reply(target + " is now a " + role)
+		return nil
+	})
+	cmds.Register("/whois", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			ctx.Reply("usage: /whois <name>")
+			return nil
+		}
+		info, err := ctx.Board.Whois(ctx.Name, ctx.Arg)
+		if err != nil {
+			return err
+		}
+		ctx.Reply(info.String())
+		return nil
+	})
+	cmds.Register("/pin", pin)
+	cmds.Register("/unpin", pin)
+	cmds.Register("/pins", func(ctx CommandContext) error {
+		pins := ctx.Board.Pins()
+		if len(pins) == 0 {
+			ctx.Reply("no pinned messages")
+		}
+		for _, m := range pins {
+			ctx.Reply(pinNotice(m))
+		}
+		return nil
+	})
+	cmds.Register("/ttl", func(ctx CommandContext) error {
+		secs, text := splitCommand(ctx.Arg)
+		n, err := strconv.Atoi(secs)
+		if err != nil || n <= 0 || text == "" {
+			ctx.Reply("usage: /ttl <seconds> <text>")
+			return nil
+		}
+		var ackCh chan<- *Notification
+		if ctx.Board.cfg.Ack != AckNone {
+			ackCh = ctx.reply
+		}
+		ctx.Board.Ephemeral(ctx.Name, text, time.Duration(n)*time.Second, ackCh)
+		return nil
+	})
+	cmds.Register("/version", func(ctx CommandContext) error {
+		ctx.Reply(ctx.Board.versionNotice())
+		return nil
+	})
+	cmds.Register("/shadowmute", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			ctx.Reply("usage: /shadowmute <name>")
+		} else if on, err := ctx.Board.ShadowMute(ctx.Name, ctx.Arg); err != nil {
+			ctx.Reply(err.Error())
+		} else if on {
+			ctx.Reply(ctx.Arg + " is now shadow-muted")
+		} else {
+			ctx.Reply(ctx.Arg + " is no longer shadow-muted")
+		}
+		return nil
+	})
+	cmds.Register("/lock", lock)
+	cmds.Register("/unlock", lock)
+	cmds.Register("/broadcast", func(ctx CommandContext) error {
+		msg := fmt.Sprintf("%s to all rooms: %s", ctx.Name, ctx.Arg)
+		switch {
+		case ctx.Arg == "":
+			ctx.Reply("usage: /broadcast <text>")
+		case !ctx.Board.cfg.isOperator(ctx.Name):
+			ctx.Reply(ErrNotOperator.Error())
+		case ctx.Board.rooms == nil:
+			ctx.Board.Announce(msg)
+		default:
+			ctx.Board.rooms.Announce(msg)
+		}
+		return nil
+	})
+	cmds.Register("/setnick", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			if nick := ctx.Board.Nick(ctx.Name); nick != "" {
+				ctx.Reply("your nickname is " + nick)
+			} else {
+				ctx.Reply("you have no nickname")
+			}
+			return nil
+		}
+		return ctx.Board.SetNick(ctx.Name, ctx.Arg)
+	})
+	return cmds
+}
+
+// awaitReceipt waits up to ReceiptTimeout for a receipt from to and says how
+// it went. Receipts are best effort: one that is late does not mean the
+// message was lost.
+func (b *Board) awaitReceipt(to string, receipt chan struct{}) string {
+	t := b.cfg.clock().NewTimer(b.cfg.ReceiptTimeout)
+	defer t.Stop()
+	select {
+	case <-receipt:
+		return "delivered to " + to
+	case <-t.C():
+		return "no receipt from " + to + " yet"
+	}
+}
+
+// splitCommand splits "/cmd rest of line" into "/cmd" and "rest of line".
+func splitCommand(line string) (string, string) {
+	fields := strings.SplitN(line, " ", 2)
+	if len(fields) == 1 {
+		return fields[0], ""
+	}
+	return fields[0], strings.TrimSpace(fields[1])
+}
+
+// notice builds a system message for a single client.
+func notice(msg string) *Notification {
+	return &Notification{
+		Type: NOTICE,
+		Msg:  msg,
+	}
+}
+
+// alert builds a system message that goes ahead of queued chat.
+func alert(msg string) *Notification {
+	n := notice(msg)
+	n.Priority = PriorityHigh
+	return n
+}
+
+// motd returns the lines of the message of the day. The file is read on each
+// call so that operators can change it without a restart.
+func (b *Board) motd() []string {
+	const none = "no message of the day"
+	if b.cfg.MotdFile == "" {
+		return []string{none}
+	}
+	data, err := os.ReadFile(b.cfg.MotdFile)
+	if err != nil {
+		return []string{none}
+	}
+	text := strings.TrimRight(string(data), "\r\n")
+	if text == "" {
+		return []string{none}
+	}
+	return strings.Split(text, "\n")
+}
+
+// seen describes the last activity of name for /seen.
+func (b *Board) seen(name string) string {
+	if name == "" {
+		return "usage: /seen <name>"
+	}
+	presence, said, online, ok := b.Seen(name)
+	if !ok {
+		return fmt.Sprintf("%s has not been seen", name)
+	}
+	now := b.cfg.clock().Now()
+	ago := func(t time.Time) time.Duration {
+		return now.Sub(t).Round(time.Second)
+	}
+	switch {
+	case online && !said.IsZero():
+		return fmt.Sprintf("%s is online, last said something %s ago", name, ago(said))
+	case online:
+		return fmt.Sprintf("%s is online, joined %s ago", name, ago(presence))
+	}
+	return fmt.Sprintf("%s was last seen %s ago", name, ago(presence))
+}
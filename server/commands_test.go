@@ -0,0 +1,629 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMotd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "motd")
+	cfg := DefaultConfig()
+	cfg.MotdFile = path
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+
+	c.send("/motd")
+	c.expect("* no message of the day")
+	if err := os.WriteFile(path, []byte("welcome\nbe nice\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The file is re-read on every request.
+	c.send("/motd")
+	c.expect("* welcome", "* be nice")
+}
+
+func TestSeen(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+
+	alice.send("/seen bob")
+	alice.expect("* bob has not been seen")
+	bob := dial(t, b, "bob")
+	clock.Advance(time.Minute)
+	alice.send("/seen bob")
+	alice.expect("* bob is online, joined 1m0s ago")
+
+	bob.send("hi")
+	alice.expect("bob: hi")
+	clock.Advance(time.Minute)
+	alice.send("/seen bob")
+	alice.expect("* bob is online, last said something 1m0s ago")
+
+	// Logging out is not saying something.
+	bob.send("/quit")
+	bob.expect("* goodbye")
+	bob.closed()
+	b.sync()
+	clock.Advance(time.Minute)
+	alice.send("/seen bob")
+	alice.expect("* bob was last seen 1m0s ago")
+}
+
+func TestGrant(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	carol := dial(t, b, "carol")
+	if admin := b.Admin(); admin != "alice" {
+		t.Fatalf("admin is %q, want the first to join", admin)
+	}
+
+	bob.send("/grant carol")
+	bob.expect("* " + ErrNotAdmin.Error())
+	alice.send("/grant dave")
+	alice.expect("* " + ErrNoSuchUser.Error())
+	alice.send("/grant carol")
+	for _, c := range []*testClient{alice, bob, carol} {
+		c.expect("* carol is now the room admin")
+	}
+
+	// When the admin leaves it passes to the longest present member.
+	carol.send("/quit")
+	carol.expect("* goodbye")
+	for _, c := range []*testClient{alice, bob} {
+		c.expect("* alice is now the room admin")
+	}
+}
+
+func TestReport(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	admin := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	dial(t, b, "mallory")
+
+	bob.send("/report mallory")
+	bob.expect("* usage: /report <name> <reason>")
+	bob.send("/report dave spam")
+	bob.expect("* " + ErrNoSuchUser.Error())
+	bob.send("/report mallory spamming links")
+	bob.expect("* report sent to the room admin")
+	admin.expect("* report from bob about mallory: spamming links")
+
+	bob.send("/report mallory again")
+	bob.expect("* " + ErrRateLimited.Error())
+	clock.Advance(cfg.ReportInterval)
+	bob.send("/report mallory again")
+	bob.expect("* report sent to the room admin")
+	admin.expect("* report from bob about mallory: again")
+}
+
+func TestWatch(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	alice.send("/watch")
+	alice.expect("* usage: /watch <name>")
+	alice.send("/watch bob")
+	alice.expect("* watching bob")
+
+	bob := dial(t, b, "bob")
+	alice.expect("* bob is now online")
+	bob.send("/quit")
+	bob.expect("* goodbye")
+	alice.expect("* bob went offline")
+
+	alice.send("/unwatch bob")
+	alice.expect("* no longer watching bob")
+	dial(t, b, "bob")
+	alice.quiet()
+}
+
+func TestUnknownCommand(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	alice.send("/frobnicate now")
+	alice.expect("* unknown command /frobnicate, try /help")
+	bob.quiet()
+	alice.send("/help")
+	if line := alice.next(); !strings.HasPrefix(line, "* commands: /quit /help ") {
+		t.Errorf("help is %q", line)
+	}
+
+	cfg := DefaultConfig()
+	cfg.UnknownCommandsAsText = true
+	b = startBoard(cfg)
+	alice = dial(t, b, "alice")
+	bob = dial(t, b, "bob")
+	alice.send("/frobnicate now")
+	bob.expect("alice: /frobnicate now")
+	alice.quiet()
+}
+
+func TestSlowMode(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	admin := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	bob.send("/slowmode 10")
+	bob.expect("* " + ErrNotAdmin.Error())
+	admin.send("/slowmode 10")
+	admin.expect("* alice set slow mode to one message per 10s")
+	bob.expect("* alice set slow mode to one message per 10s")
+	bob.send("/slowmode")
+	bob.expect("* slow mode: one message per 10s")
+
+	bob.send("one")
+	admin.expect("bob: one")
+	clock.Advance(4 * time.Second)
+	bob.send("two")
+	bob.expect("* slow down, you can send again in 6s")
+	clock.Advance(6 * time.Second)
+	bob.send("three")
+	admin.expect("bob: three")
+
+	admin.send("/slowmode 0")
+	admin.expect("* alice turned slow mode off")
+	bob.expect("* alice turned slow mode off")
+	bob.send("four")
+	bob.send("five")
+	admin.expect("bob: four", "bob: five")
+	bob.quiet()
+}
+
+func TestThrottleNoticeWindow(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.SlowMode = 10 * time.Second
+	cfg.ThrottleNoticeWindow = 5 * time.Second
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	bob.send("one")
+	alice.expect("bob: one")
+	clock.Advance(time.Second)
+	bob.send("two")
+	bob.expect("* slow down, you can send again in 9s")
+	clock.Advance(time.Second)
+	bob.send("three")
+	bob.send("four")
+	bob.quiet()
+
+	clock.Advance(5 * time.Second)
+	bob.send("five")
+	bob.expect("* slow down, you can send again in 3s")
+	clock.Advance(3 * time.Second)
+	bob.expect("* you can send again")
+	bob.send("six")
+	alice.expect("bob: six")
+	alice.quiet()
+	bob.quiet()
+}
+
+func TestDirectMessage(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	carol := dial(t, b, "carol")
+
+	alice.send("/msg -r bob psst")
+	bob.expect("alice (private): psst")
+	alice.expect("* delivered to bob")
+	alice.send("/msg bob again")
+	bob.expect("alice (private): again")
+	alice.quiet()
+	carol.quiet()
+
+	alice.send("/msg -r dave hello")
+	alice.expect("* dave is not here, not delivered")
+	alice.send("/msg bob")
+	alice.expect("* usage: /msg [-r] <name> <text>")
+}
+
+func TestDirectMessageReceiptTimeout(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration)
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	// An in-process client never writes to a connection, so never sends
+	// a receipt.
+	dave := make(chan *Notification, 10)
+	b.Login("dave", dave)
+
+	alice.send("/msg -r dave hello")
+	if n := recv(t, dave); n.Type != DIRECT || n.Name != "alice" || n.Msg != "hello" {
+		t.Errorf("dave got %+v", n)
+	}
+	clock.Advance(<-clock.started)
+	alice.expect("* no receipt from dave yet")
+}
+
+func TestRecent(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.RecentSize = 3
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	alice.send("/recent")
+	alice.expect("* 00:00:00 alice joined")
+
+	clock.Advance(time.Minute)
+	bob := dial(t, b, "bob")
+	clock.Advance(time.Minute)
+	bob.send("/quit")
+	bob.expect("* goodbye")
+	bob.closed()
+	clock.Advance(time.Minute)
+	dial(t, b, "carol")
+	// Only the last three are kept.
+	alice.send("/recent")
+	alice.expect("* 00:01:00 bob joined", "* 00:02:00 bob left", "* 00:03:00 carol joined")
+}
+
+func TestAway(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	bob.send("/away lunch")
+	bob.expect("* you are away: lunch")
+	alice.send("/who")
+	alice.expect("* here: alice, bob (away: lunch)")
+	alice.send("/msg bob are you there?")
+	alice.expect("* bob is away: lunch")
+	bob.expect("alice (private): are you there?")
+
+	bob.send("/back")
+	bob.expect("* welcome back")
+	alice.send("/msg bob now?")
+	bob.expect("alice (private): now?")
+	alice.send("/who")
+	alice.expect("* here: alice, bob")
+}
+
+func TestReply(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ShowSeq = true
+	cfg.HistorySize = 10
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	alice.send("hello")
+	bob.expect("#1 alice: hello")
+	bob.send("/reply 1 hi there")
+	alice.expect("#2 bob (re #1): hi there")
+	bob.send("/reply #2 and again")
+	alice.expect("#3 bob (re #2): and again")
+	// The thread survives a replay to someone joining later.
+	carol := dial(t, b, "carol")
+	carol.expect("#1 alice: hello", "#2 bob (re #1): hi there", "#3 bob (re #2): and again")
+
+	bob.send("/reply 42 anyone?")
+	bob.expect("* there is no message #42 to reply to")
+	bob.send("/reply 1")
+	bob.expect("* usage: /reply <msgid> <text>")
+	alice.quiet()
+}
+
+func TestRedact(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ShowSeq = true
+	cfg.HistorySize = 10
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	bob.send("oops")
+	bob.send("fine")
+	alice.expect("#1 bob: oops", "#2 bob: fine")
+
+	bob.send("/redact 1")
+	bob.expect("* only the room admin can do that")
+	alice.send("/redact #1")
+	alice.expect("* message #1 was redacted")
+	bob.expect("* message #1 was redacted")
+	// Later joiners never see it.
+	carol := dial(t, b, "carol")
+	carol.expect("#2 bob: fine")
+	carol.quiet()
+	if h := historyOf(b); h != "[fine]" {
+		t.Errorf("history is %s", h)
+	}
+
+	alice.send("/redact 9")
+	alice.expect("* no such message")
+	alice.send("/redact")
+	alice.expect("* usage: /redact <msgid>")
+}
+
+func TestPin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ShowSeq = true
+	cfg.HistorySize = 1
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	bob.send("read the rules")
+	alice.expect("#1 bob: read the rules")
+
+	bob.send("/pin 1")
+	bob.expect("* only the room admin can do that")
+	alice.send("/pin #1")
+	alice.expect("* alice pinned message #1")
+	bob.expect("* alice pinned message #1")
+	alice.send("/pin 1")
+	alice.send("/pin 9")
+	alice.expect("* no such message")
+
+	// It stays pinned after it has left the history.
+	bob.send("hello")
+	alice.expect("#2 bob: hello")
+	carol := dial(t, b, "carol")
+	carol.expect("#2 bob: hello", "* pinned #1 bob: read the rules")
+	carol.quiet()
+	carol.send("/pins")
+	carol.expect("* pinned #1 bob: read the rules")
+
+	alice.send("/unpin 1")
+	alice.expect("* alice unpinned message #1")
+	alice.send("/unpin 1")
+	alice.expect("* no such message")
+	alice.send("/pins")
+	alice.expect("* no pinned messages")
+	alice.send("/unpin")
+	alice.expect("* usage: /unpin <msgid>")
+}
+
+func TestEphemeral(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistorySize = 10
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	bob.send("/ttl 30 gone soon")
+	bob.send("here to stay")
+	alice.expect("bob: gone soon", "bob: here to stay")
+
+	// Later joiners only see what was kept.
+	carol := dial(t, b, "carol")
+	carol.expect("bob: here to stay")
+	carol.quiet()
+	if h := historyOf(b); h != "[here to stay]" {
+		t.Errorf("history is %s", h)
+	}
+
+	bob.send("/ttl 0 never")
+	bob.expect("* usage: /ttl <seconds> <text>")
+	bob.send("/ttl 30")
+	bob.expect("* usage: /ttl <seconds> <text>")
+}
+
+func TestRoleCommand(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	alice.send("/role bob spectator")
+	alice.expect("* bob is now a spectator")
+	bob.send("/role alice spectator")
+	bob.expect("* only the room admin can do that")
+	alice.send("/role bob admin")
+	alice.expect("* usage: /role <name> regular|spectator")
+	alice.send("/role carol regular")
+	alice.expect("* no such user")
+	// Spectators still get everything they keep up with.
+	alice.send("hi")
+	bob.expect("alice: hi")
+}
+
+func TestWhois(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	bob.send("one")
+	bob.send("two")
+	alice.expect("bob: one", "bob: two")
+	clock.Advance(90 * time.Second)
+	b.Login("carl", make(chan *Notification, 10))
+
+	alice.send("/whois bob")
+	alice.expect("* bob: from pipe since 2017-01-01 00:00:00, 2 messages sent, in room test, regular, idle 1m30s")
+	alice.send("/whois carl")
+	alice.expect("* carl: in-process, 0 messages sent, in room test, regular, idle 0s")
+	alice.send("/whois dave")
+	alice.expect("* no such user")
+	bob.send("/whois alice")
+	bob.expect("* only the room admin can do that")
+}
+
+func TestVersion(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	alice.send("/version")
+	alice.expect("* go-chat-simple " + Version + ", no optional features")
+
+	cfg := DefaultConfig()
+	cfg.HistorySize = 10
+	cfg.Ack = AckQueued
+	cfg.Compression = true
+	boards := NewBoardRegistry(cfg)
+	defer boards.Close()
+	bob := dial(t, boards.GetOrCreate("lobby"), "bob")
+	bob.send("/version")
+	bob.expect("* go-chat-simple " + Version + ", features: history acks rooms compression")
+}
+
+func TestShadowMute(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EchoToSender = true
+	cfg.HistorySize = 10
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	carol := dial(t, b, "carol")
+
+	bob.send("/shadowmute carol")
+	bob.expect("* only the room admin can do that")
+	alice.send("/shadowmute carol")
+	alice.expect("* carol is now shadow-muted")
+
+	// carol's own messages come back as ever, but reach nobody else.
+	carol.send("buy my stuff @bob")
+	carol.expect("you: buy my stuff @bob")
+	bob.send("hi")
+	alice.expect("bob: hi")
+	bob.expect("you: hi")
+	carol.expect("bob: hi")
+	dave := dial(t, b, "dave")
+	dave.expect("bob: hi")
+	dave.quiet()
+
+	alice.send("/shadowmute carol")
+	alice.expect("* carol is no longer shadow-muted")
+	carol.send("sorry")
+	alice.expect("carol: sorry")
+	alice.send("/shadowmute nobody")
+	alice.expect("* " + ErrNoSuchUser.Error())
+}
+
+func TestLock(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	bob.send("/lock")
+	bob.expect("* only the room admin can do that")
+	alice.send("/lock")
+	alice.expect("* alice locked the room")
+	bob.expect("* alice locked the room")
+
+	carol := connect(t, b)
+	carol.expect("username> ")
+	carol.send("carol")
+	carol.expect(ErrRoomLocked.Error())
+	carol.closed()
+	// Those already here carry on.
+	bob.send("still here")
+	alice.expect("bob: still here")
+
+	alice.send("/unlock")
+	alice.expect("* alice unlocked the room")
+	bob.expect("* alice unlocked the room")
+	carol = dial(t, b, "carol")
+	carol.send("hi")
+	alice.expect("carol: hi")
+}
+
+func TestSetNick(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	alice.send("/setnick")
+	alice.expect("* you have no nickname")
+	alice.send("/setnick Ally")
+	alice.expect("* alice is now known as Ally")
+	bob.expect("* alice is now known as Ally")
+	alice.send("/setnick")
+	alice.expect("* your nickname is Ally")
+	alice.send("hi")
+	bob.expect("Ally: hi")
+
+	// Private messages still go by login name, both ways.
+	bob.send("/msg alice psst")
+	alice.expect("bob (private): psst")
+	bob.send("/msg Ally psst")
+	bob.expect("* Ally is not here, not delivered")
+	alice.send("/msg bob hello")
+	bob.expect("Ally (private): hello")
+
+	// Nobody can pass for someone else.
+	bob.send("/setnick alice")
+	bob.expect("* " + ErrNickInUse.Error())
+	bob.send("/setnick Ally")
+	bob.expect("* " + ErrNickInUse.Error())
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("Ally")
+	c.expect(ErrNameTaken.Error(), "username> ")
+
+	alice.send("/setnick alice")
+	alice.expect("* Ally is now known as alice")
+	bob.expect("* Ally is now known as alice")
+	alice.send("back")
+	bob.expect("alice: back")
+}
+
+func TestCustomCommand(t *testing.T) {
+	cmds := NewCommandRegistry()
+	cmds.Register("/roll", func(ctx CommandContext) error {
+		if ctx.Arg == "" {
+			return errors.New("usage: /roll <sides>")
+		}
+		ctx.Board.Announce(ctx.Name + " rolled a d" + ctx.Arg)
+		return nil
+	})
+	// A built-in can be replaced, keeping its place in /help.
+	cmds.Register("/who", func(ctx CommandContext) error {
+		ctx.Reply("nobody but us")
+		return nil
+	})
+	cfg := DefaultConfig()
+	cfg.Commands = cmds
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	alice.send("/roll 6")
+	alice.expect("* alice rolled a d6")
+	bob.expect("* alice rolled a d6")
+	alice.send("/roll")
+	alice.expect("* usage: /roll <sides>")
+	alice.send("/who")
+	alice.expect("* nobody but us")
+	alice.send("/help")
+	help := alice.next()
+	if !strings.HasSuffix(help, " /setnick /roll") || !strings.Contains(help, " /recent /who /away ") {
+		t.Errorf("help is %q", help)
+	}
+
+	// Boards without the registry have only the built-in commands.
+	other := dial(t, startBoard(DefaultConfig()), "carol")
+	other.send("/roll 6")
+	other.expect("* unknown command /roll, try /help")
+}
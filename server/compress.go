@@ -0,0 +1,66 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+)
+
+// compressHello is the byte a client sends ahead of its reply to the first
+// prompt to ask for compression. The server echoes it back to agree, after
+// which both directions are DEFLATE streams, flushed at every message. It
+// can never begin a line from a client that does not know about it, so
+// such clients are left in plain text.
+const compressHello = 0x1f
+
+// negotiateCompression looks at the first byte the client sent and, if it
+// asks for compression, agrees and returns the streams wrapped to match.
+// Otherwise reader and writer are returned as they are. Only for use before
+// anything but the first prompt has been exchanged.
+func negotiateCompression(reader *bufio.Reader, writer *bufio.Writer, w io.Writer) (*bufio.Reader, *bufio.Writer, error) {
+	hello, err := reader.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hello[0] != compressHello {
+		return reader, writer, nil
+	}
+	reader.Discard(1)
+	if err := writer.WriteByte(compressHello); err != nil {
+		return nil, nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, nil, err
+	}
+	fw, _ := flate.NewWriter(w, flate.BestSpeed)
+	return bufio.NewReader(flate.NewReader(reader)), bufio.NewWriter(&flushWriter{fw}), nil
+}
+
+// flushWriter flushes the compressor after every write, which the
+// bufio.Writer above only makes when it is flushed, so that each message
+// reaches the client whole rather than waiting on the next.
+type flushWriter struct {
+	fw *flate.Writer
+}
+
+func (f *flushWriter) Write(buf []byte) (int, error) {
+	n, err := f.fw.Write(buf)
+	if err != nil {
+		return n, err
+	}
+	return n, f.fw.Flush()
+}
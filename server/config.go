@@ -0,0 +1,418 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"reflect"
+	"time"
+)
+
+// AckMode selects when a publishing client is told its message was accepted.
+type AckMode int
+
+const (
+	// AckNone sends no acknowledgements.
+	AckNone AckMode = iota
+	// AckQueued acknowledges once the board has accepted the message for
+	// fan-out.
+	AckQueued
+	// AckDelivered acknowledges once the message has been handed to every
+	// other client on the board. No ACK is sent if a full send queue made
+	// the board drop it for anyone, so the publisher can resend.
+	AckDelivered
+)
+
+// OverflowPolicy selects what a board does with a message for a client whose
+// send queue is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the message that does not fit, so the client misses
+	// the latest traffic but sees what it had queued.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the message that has waited longest to make room,
+	// so the client catches up on the latest traffic. Only a queue the
+	// board owns can be taken from, so every client is then given one as
+	// with DeliveryWorkers.
+	DropOldest
+	// DisconnectSlow hangs up on the client, which can reconnect once it
+	// keeps up. In-process clients have no connection to hang up and miss
+	// the message instead, as with DropNewest.
+	DisconnectSlow
+)
+
+// BoardConfig holds the settings that may differ from one room to another.
+type BoardConfig struct {
+	// MaxClients refuses logins once a board has this many clients. Zero
+	// means no limit.
+	MaxClients int
+	// WaitQueueSize, when MaxClients is reached, lets up to this many more
+	// logins wait in line for a place instead of being refused.
+	WaitQueueSize int
+	// HistorySize is the number of recent messages kept and replayed to
+	// clients when they join.
+	HistorySize int
+	// Ack enables per-message acknowledgements to the publisher.
+	Ack AckMode
+	// BannedWords are masked with asterisks in published messages. Matching
+	// ignores case.
+	BannedWords []string
+	// BannedWordsWholeWord restricts BannedWords to whole-word matches, so
+	// that e.g. "ass" does not mask part of "class".
+	BannedWordsWholeWord bool
+	// SendQueueSize is the number of messages buffered for each client. When
+	// zero the board waits on every client in turn; otherwise messages to a
+	// client with a full queue are dropped.
+	SendQueueSize int
+	// DeliveryWorkers gives every client a goroutine of its own that hands
+	// it messages in order from a queue, so that a slow client no longer
+	// holds up the board and everyone after it. SendQueueSize then bounds
+	// that queue, and zero leaves it unbounded.
+	DeliveryWorkers bool
+	// Overflow is what happens when a client's send queue is full. It has
+	// no effect without a SendQueueSize.
+	Overflow OverflowPolicy
+	// HighWatermark and LowWatermark, if set, log a warning when a client's
+	// queue reaches HighWatermark and clear it once it is back down to
+	// LowWatermark. The gap avoids flapping around a single threshold.
+	HighWatermark int
+	LowWatermark  int
+	// MaxMessageBytes and MaxMessageRunes refuse messages longer than this
+	// many bytes or Unicode code points, telling the sender why. Counting
+	// runes treats every script alike, where a byte limit lets through
+	// fewer CJK characters than Latin ones. Zero means no limit.
+	MaxMessageBytes int
+	MaxMessageRunes int
+	// NotifyBlank tells the sender of a message that is blank, once
+	// whitespace is trimmed from either end, that it was not sent, rather
+	// than dropping it silently.
+	NotifyBlank bool
+	// FragmentSize splits messages longer than this many bytes into
+	// numbered fragments instead of sending them whole. Zero disables it.
+	FragmentSize int
+	// ShowSeq prefixes each message with its board sequence number, as in
+	// "#12 alice: hi", so that clients can notice dropped messages.
+	ShowSeq bool
+	// ColorNames draws sender names in ANSI colors, picked by ColorForName,
+	// for the text protocols.
+	ColorNames bool
+	// CRLF ends the lines sent by the text protocol with "\r\n" rather
+	// than "\n", as raw telnet on Windows expects. A client can also ask
+	// for it for itself by listing crlf in its CAPS.
+	CRLF bool
+	// EscapeMarkdown backslash-escapes markdown formatting characters in
+	// user messages, for clients that render them as markdown. Server
+	// notices are left alone.
+	EscapeMarkdown bool
+	// AllowAnonymous lets a client log in with an empty name, in which case
+	// it is given a unique name from Config.Names.
+	AllowAnonymous bool
+	// MaxNameLength, if set, is the most runes a name may have. Longer
+	// names are refused with ErrNameTooLong, so that the client is asked
+	// again, or with TruncateNames cut down to size, for clients that
+	// cannot be asked again.
+	MaxNameLength int
+	// TruncateNames cuts names longer than MaxNameLength down to size
+	// rather than refusing them. A cut name that is in use gets a numbered
+	// suffix instead.
+	TruncateNames bool
+	// MessageTemplate, if set, is a text/template that clients reading
+	// plain or timestamped text are shown messages with, instead of
+	// "name: text". It is given the message's Notification, so for example
+	// "[{{.Time.Format "15:04"}}] {{.Name}}: {{.Msg}}".
+	MessageTemplate string
+	// PresenceNotices tells the room whenever someone joins or leaves.
+	PresenceNotices bool
+	// CoalesceWindow, if set, batches join and leave notices that happen
+	// within this interval into a single line per kind.
+	CoalesceWindow time.Duration
+	// LeaveGrace, if set, holds back a leave notice for this long. If the
+	// user logs back in meanwhile neither the leave nor the join is
+	// announced, so that a flaky connection does not fill the room with
+	// churn.
+	LeaveGrace time.Duration
+	// SlowMode, if set, is the least time allowed between two messages
+	// from the same user. The admin can change it with /slowmode.
+	SlowMode time.Duration
+	// ReportInterval is the minimum time between two /report commands from
+	// the same user.
+	ReportInterval time.Duration
+	// RecentSize is the number of logins and logouts kept for /recent.
+	RecentSize int
+	// FloodMessages, FloodWindow and FloodMute, if all set, mute a user who
+	// sends more than FloodMessages messages within FloodWindow. Their
+	// messages are dropped until FloodMute has passed.
+	FloodMessages int
+	FloodWindow   time.Duration
+	FloodMute     time.Duration
+	// FloodNotifyAdmin also tells the room admin whenever someone is muted.
+	FloodNotifyAdmin bool
+	// ThrottleNoticeWindow, if set, tells a user whose messages slow mode or
+	// flood protection drops at most once per window, and once more when
+	// they can send again, rather than after every dropped message.
+	ThrottleNoticeWindow time.Duration
+	// EchoToSender sends every message back to its author too, for clients
+	// without local echo. The author's copy reads "you: text".
+	EchoToSender bool
+	// MentionPings follows a message that mentions someone by "@name" with
+	// a notice telling them so, for clients that cannot highlight.
+	MentionPings bool
+}
+
+// Config holds the tunables for a server and the boards it hosts.
+type Config struct {
+	// Addr is the TCP address to listen on.
+	Addr string
+	// BoardConfig is the default for every board.
+	BoardConfig
+	// ProxyIdentity is for servers that are only reached through an auth
+	// proxy. The proxy sends "IDENTITY <name>" as the first line of every
+	// connection, and that name is logged in without a prompt. Connections
+	// without one are refused. Unless every connection comes from the
+	// proxy this lets anyone log in as anyone.
+	ProxyIdentity bool
+	// Operators names the users who may act on the whole server rather
+	// than one room, with /broadcast, /create, /transcript, /ban and
+	// /unban. Being the admin of a room is not enough, since anyone who
+	// /joins a new room becomes its admin. A name is only as trustworthy as
+	// the login, so operators are best combined with ProxyIdentity.
+	Operators []string
+	// FederationSecret is shared with peer servers to sign the messages
+	// passed between them. Without it federated messages are refused.
+	FederationSecret []byte
+	// FederationMaxAge refuses federated messages sent longer ago than
+	// this, so that one recorded off the link cannot be played back later.
+	// Zero accepts any age. Either way each peer's messages are only taken
+	// in the order they were sent, and once.
+	FederationMaxAge time.Duration
+	// Compression lets clients ask for their connection to be compressed.
+	// Clients that do not ask still get plain text.
+	Compression bool
+	// WrapReader and WrapWriter, if set, are applied to every connection
+	// Serve handles, for taps or line-level encryption. They are called
+	// once per connection and see the bytes as sent, beneath compression.
+	WrapReader func(io.Reader) io.Reader
+	WrapWriter func(io.Writer) io.Writer
+	// ReusePort sets SO_REUSEPORT on the listener so that more than one
+	// server can bind Addr at once. Only supported on Linux and the BSDs.
+	ReusePort bool
+	// Backlog, if set, is the length of the listener's queue of connections
+	// not yet accepted. By default the system maximum is used. Only
+	// supported on Linux and the BSDs.
+	Backlog int
+	// MaxConnections turns away connections beyond this many at once. Zero
+	// means no limit.
+	MaxConnections int
+	// ReconnectLimit, ReconnectWindow and ReconnectCooldown, if all set,
+	// turn away every connection from an IP for ReconnectCooldown once it
+	// has connected more than ReconnectLimit times within ReconnectWindow,
+	// so that a client cycling in a tight loop cannot thrash the server.
+	ReconnectLimit    int
+	ReconnectWindow   time.Duration
+	ReconnectCooldown time.Duration
+	// ConnectionWait, if set, holds a connection beyond MaxConnections for
+	// up to this long in case another one closes, before turning it away.
+	ConnectionWait time.Duration
+	// KeepAlive, if positive, turns on TCP keepalive probes for accepted
+	// connections at this period, so that peers that vanish without closing
+	// are noticed. A negative value turns keepalives off; zero leaves the
+	// system defaults alone.
+	KeepAlive time.Duration
+	// RetryAfter is the back-off suggested to clients refused for lack of
+	// capacity.
+	RetryAfter time.Duration
+	// DrainPeriod is how long Server.Shutdown lets clients stay on after
+	// telling them the server is going away, before it closes the rooms.
+	DrainPeriod time.Duration
+	// DrainRetryAfter, if set, is sent by Server.Shutdown as a
+	// "retry-after" line, as for RetryAfter, suggesting when clients should
+	// reconnect, for example once a rolling restart is through.
+	DrainRetryAfter time.Duration
+	// ReapAfter closes a board created by a BoardRegistry once it has been
+	// empty for this long, so that rooms nobody uses do not pile up. Zero
+	// keeps every board.
+	ReapAfter time.Duration
+	// MaxRooms caps the number of boards a BoardRegistry holds at once, so
+	// that /join cannot create rooms without bound. Zero means no limit.
+	MaxRooms int
+	// HistoryBudget caps the bytes of history kept by all the boards of a
+	// BoardRegistry together. Past it, the oldest messages are evicted
+	// whatever board they are on. Zero means no limit beyond each board's
+	// HistorySize.
+	HistoryBudget int
+	// ExplicitRooms stops /join from creating rooms, so that a typo does not
+	// make a new one. Only rooms in Rooms, or made by an admin with /create
+	// or BoardRegistry.Create, can then be joined.
+	ExplicitRooms bool
+	// DefaultRoom is where Run puts every connection once it has logged in,
+	// until it joins another room with /join. A BoardRegistry never reaps
+	// it, so there is always somewhere to land. Defaults to "1".
+	DefaultRoom string
+	// FallbackRoom, if set, is where BoardRegistry.CloseRoom moves the
+	// clients of a room it closes.
+	FallbackRoom string
+	// Announcements are sent to every room of a BoardRegistry at the times
+	// they give, until the registry is closed.
+	Announcements []Announcement
+	// Rooms overrides BoardConfig for the boards named by its keys.
+	Rooms map[string]RoomConfig
+	// MotdFile is sent to clients asking for /motd. It is re-read on every
+	// request.
+	MotdFile string
+	// UnknownCommandsAsText publishes a line that looks like a command but
+	// is not one as ordinary text. By default the client is told the
+	// command is unknown instead.
+	UnknownCommandsAsText bool
+	// Bans lists user names and IPs that are refused at login.
+	Bans *BanList
+	// IdleTimeout disconnects clients that have sent nothing for this long.
+	// Zero disables it.
+	IdleTimeout time.Duration
+	// IdleCheckInterval, if set, checks clients against IdleTimeout this
+	// often rather than keeping a timer to the exact moment each one times
+	// out, which saves resetting it for every line a client sends. Clients
+	// are then disconnected up to this long after their timeout.
+	IdleCheckInterval time.Duration
+	// WriteTimeout disconnects a client that takes longer than this to
+	// accept a single message. It is separate from IdleTimeout, which is
+	// about the client sending nothing. Zero disables it.
+	WriteTimeout time.Duration
+	// FlushInterval, if set, writes a client's messages out together at
+	// most this long after the first of them, or sooner when its buffer
+	// fills, rather than one at a time. It saves system calls in busy rooms
+	// at the cost of latency. Zero writes every message out at once.
+	FlushInterval time.Duration
+	// MaxSessionDuration disconnects every client this long after it logs
+	// in, active or not. Zero disables it.
+	MaxSessionDuration time.Duration
+	// ReauthOnExpiry, rather than disconnecting a client whose session has
+	// expired, logs it out and prompts for a name again on the same
+	// connection.
+	ReauthOnExpiry bool
+	// ReceiptTimeout bounds how long /msg -r waits for the recipient's
+	// client to be written the message.
+	ReceiptTimeout time.Duration
+	// FlushTimeout bounds how long a client leaving with /quit may take to
+	// receive the messages still queued for it. Zero waits indefinitely.
+	FlushTimeout time.Duration
+	// Events, if set, receives a record of connections, logins, messages,
+	// logouts and errors.
+	Events *EventStream
+	// OnCountChange, if set, is called with a board's name and its new
+	// number of clients whenever a login or logout changes it. It runs on
+	// the board goroutine and must not block.
+	OnCountChange func(board string, n int)
+	// Clock is used for all timers. Defaults to RealClock.
+	Clock Clock
+	// Commands holds the slash commands clients can type. Defaults to the
+	// built-in ones.
+	Commands *CommandRegistry
+	// Names picks the names of anonymous logins. Defaults to "guest-N".
+	Names NameGenerator
+}
+
+// DefaultConfig returns the configuration matching the original behavior of
+// the server.
+func DefaultConfig() Config {
+	return Config{
+		Addr: ":5001",
+		BoardConfig: BoardConfig{
+			ReportInterval: time.Minute,
+			RecentSize:     10,
+		},
+		RetryAfter:       30 * time.Second,
+		ReceiptTimeout:   5 * time.Second,
+		FlushTimeout:     2 * time.Second,
+		FederationMaxAge: time.Minute,
+		Clock:            RealClock{},
+	}
+}
+
+// defaultRoom returns the DefaultRoom, falling back to "1".
+func (c *Config) defaultRoom() string {
+	if c.DefaultRoom == "" {
+		return "1"
+	}
+	return c.DefaultRoom
+}
+
+// clock returns the configured Clock, falling back to the real one so that a
+// hand-built Config still works.
+func (c *Config) clock() Clock {
+	if c.Clock == nil {
+		return RealClock{}
+	}
+	return c.Clock
+}
+
+// RoomConfig overrides the BoardConfig defaults for a single room. Each field
+// mirrors the BoardConfig field of the same name, and only those that are set
+// take effect, so a room can override a default down to zero.
+type RoomConfig struct {
+	MaxClients           *int
+	WaitQueueSize        *int
+	HistorySize          *int
+	Ack                  *AckMode
+	BannedWords          *[]string
+	BannedWordsWholeWord *bool
+	SendQueueSize        *int
+	DeliveryWorkers      *bool
+	Overflow             *OverflowPolicy
+	HighWatermark        *int
+	LowWatermark         *int
+	MaxMessageBytes      *int
+	MaxMessageRunes      *int
+	NotifyBlank          *bool
+	FragmentSize         *int
+	ShowSeq              *bool
+	ColorNames           *bool
+	CRLF                 *bool
+	EscapeMarkdown       *bool
+	AllowAnonymous       *bool
+	MaxNameLength        *int
+	TruncateNames        *bool
+	MessageTemplate      *string
+	PresenceNotices      *bool
+	CoalesceWindow       *time.Duration
+	LeaveGrace           *time.Duration
+	SlowMode             *time.Duration
+	ReportInterval       *time.Duration
+	RecentSize           *int
+	FloodMessages        *int
+	FloodWindow          *time.Duration
+	FloodMute            *time.Duration
+	FloodNotifyAdmin     *bool
+	ThrottleNoticeWindow *time.Duration
+	EchoToSender         *bool
+	MentionPings         *bool
+}
+
+// ForRoom returns the configuration for the board called name: c with the
+// room's override, if any, applied on top of the defaults.
+func (c Config) ForRoom(name string) Config {
+	over, ok := c.Rooms[name]
+	if !ok {
+		return c
+	}
+	dst := reflect.ValueOf(&c.BoardConfig).Elem()
+	src := reflect.ValueOf(over)
+	for i := 0; i < src.NumField(); i++ {
+		if f := src.Field(i); !f.IsNil() {
+			dst.FieldByName(src.Type().Field(i).Name).Set(f.Elem())
+		}
+	}
+	return c
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRoomOverride(t *testing.T) {
+	one, unlimited := 1, 0
+	cfg := DefaultConfig()
+	cfg.MaxClients = 2
+	cfg.Rooms = map[string]RoomConfig{
+		"small": {MaxClients: &one},
+		"big":   {MaxClients: &unlimited},
+	}
+	boards := NewBoardRegistry(cfg)
+	for _, tc := range []struct {
+		room string
+		fits int
+		next error
+	}{
+		{"small", 1, ErrRoomFull},
+		{"lobby", 2, ErrRoomFull},
+		{"big", 10, nil},
+	} {
+		b := boards.GetOrCreate(tc.room)
+		for i := 0; i < tc.fits; i++ {
+			if err := b.Login(fmt.Sprint("user", i), make(chan *Notification, 10)); err != nil {
+				t.Fatalf("%s: login %d failed: %v", tc.room, i+1, err)
+			}
+		}
+		if err := b.Login("last", make(chan *Notification, 10)); err != tc.next {
+			t.Errorf("%s: login %d got %v, want %v", tc.room, tc.fits+1, err, tc.next)
+		}
+	}
+}
+
+func TestRoomConfigMirrorsBoardConfig(t *testing.T) {
+	board := reflect.TypeOf(BoardConfig{})
+	room := reflect.TypeOf(RoomConfig{})
+	if room.NumField() != board.NumField() {
+		t.Errorf("RoomConfig has %d fields, BoardConfig %d", room.NumField(), board.NumField())
+	}
+	for i := 0; i < room.NumField(); i++ {
+		f := room.Field(i)
+		bf, ok := board.FieldByName(f.Name)
+		if !ok || f.Type != reflect.PointerTo(bf.Type) {
+			t.Errorf("RoomConfig.%s has no BoardConfig counterpart", f.Name)
+		}
+	}
+}
+
+func TestNewBoardConfig(t *testing.T) {
+	b := NewBoard("x", BoardConfig{MaxClients: 1})
+	go b.HandleBoard()
+	b.Login("alice", make(chan *Notification, 10))
+	if err := b.Login("bob", make(chan *Notification, 10)); err != ErrRoomFull {
+		t.Errorf("got %v, want ErrRoomFull", err)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Shutdown stops listening and tells every client in every room that the
+// server is going away, with a "retry-after" line suggesting when to come
+// back if cfg.DrainRetryAfter is set. Rooms carry on as usual for
+// cfg.DrainPeriod, so that clients can leave in their own time, and are then
+// closed as by Close.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	l := s.l
+	s.l = nil
+	s.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+	fmt.Printf("draining for %s\n", s.cfg.DrainPeriod)
+	for _, room := range s.boards.Names() {
+		if b := s.boards.Get(room); b != nil {
+			b.drain(s.cfg.DrainRetryAfter)
+		}
+	}
+	if s.cfg.DrainPeriod > 0 {
+		t := s.cfg.clock().NewTimer(s.cfg.DrainPeriod)
+		<-t.C()
+	}
+	s.Close()
+}
+
+// drain tells everyone on the board that the server is going away and, if
+// retryAfter is set, when to reconnect.
+func (b *Board) drain(retryAfter time.Duration) {
+	b.query(func() {
+		b.announce("server is shutting down")
+		if retryAfter <= 0 {
+			return
+		}
+		secs := int64((retryAfter + time.Second - 1) / time.Second)
+		for name, c := range b.clients {
+			n := alert(fmt.Sprintf("retry-after %d", secs))
+			n.line = true
+			b.deliver(name, c, n)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type EventType int
+
+const (
+	EventConnect EventType = iota
+	EventLogin
+	EventMessage
+	EventLogout
+	EventError
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnect:
+		return "connect"
+	case EventLogin:
+		return "login"
+	case EventMessage:
+		return "message"
+	case EventLogout:
+		return "logout"
+	case EventError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// Event is a record of something that happened on the server, for shipping
+// to an external log pipeline. Fields that do not apply are left empty.
+type Event struct {
+	Type  EventType
+	Time  time.Time
+	Board string
+	Name  string
+	Addr  string
+	Msg   string
+	Err   error
+}
+
+// EventStream is a buffered feed of Events. Events from a single board are
+// emitted in the order the board handled them. When the buffer is full,
+// events are either dropped and counted or, if the stream was created
+// blocking, the server waits for the consumer.
+type EventStream struct {
+	// C is where the consumer reads events from.
+	C <-chan Event
+
+	c       chan Event
+	block   bool
+	dropped uint64
+}
+
+// NewEventStream returns a stream buffering up to size events.
+func NewEventStream(size int, block bool) *EventStream {
+	c := make(chan Event, size)
+	return &EventStream{
+		C:     c,
+		c:     c,
+		block: block,
+	}
+}
+
+// Dropped returns the number of events lost to a slow consumer.
+func (s *EventStream) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// emit queues e. A nil stream discards it.
+func (s *EventStream) emit(e Event) {
+	if s == nil {
+		return
+	}
+	if s.block {
+		s.c <- e
+		return
+	}
+	select {
+	case s.c <- e:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+func TestEventStream(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Events = NewEventStream(10, true)
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+	c.send("hello")
+	c.send("/quit")
+	c.expect("* goodbye")
+
+	for _, want := range []Event{
+		{Type: EventConnect},
+		{Type: EventLogin, Name: "alice"},
+		{Type: EventMessage, Name: "alice", Msg: "hello"},
+		{Type: EventLogout, Name: "alice"},
+	} {
+		e := <-cfg.Events.C
+		if e.Type != want.Type || e.Name != want.Name || e.Msg != want.Msg || e.Board != "test" {
+			t.Errorf("got %v event %+v, want %+v", e.Type, e, want)
+		}
+	}
+}
+
+func TestEventStreamDrops(t *testing.T) {
+	s := NewEventStream(1, false)
+	s.emit(Event{Type: EventLogin})
+	s.emit(Event{Type: EventLogout})
+	if d := s.Dropped(); d != 1 {
+		t.Errorf("dropped %d, want 1", d)
+	}
+	if e := <-s.C; e.Type != EventLogin {
+		t.Errorf("kept %v, want the first event", e.Type)
+	}
+	var nilStream *EventStream
+	nilStream.emit(Event{})
+}
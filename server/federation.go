@@ -0,0 +1,107 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrFederationDisabled is returned by AcceptFederated when the server has
+// no FederationSecret.
+var ErrFederationDisabled = errors.New("federation is not enabled on this server")
+
+// ErrBadSignature is returned by AcceptFederated for a message whose
+// signature does not match.
+var ErrBadSignature = errors.New("bad signature")
+
+// ErrReplayed is returned by AcceptFederated for a message that is older
+// than the FederationMaxAge, or than one already taken from its origin.
+var ErrReplayed = errors.New("stale or repeated federated message")
+
+// FederatedMessage is a message passed between servers sharing a board. It
+// is signed with the secret the servers share, so that a board only takes
+// messages from its peers. There is no transport here yet: a message is
+// encoded however the link between servers likes, for example as JSON.
+type FederatedMessage struct {
+	// Origin names the server the message was published on.
+	Origin string
+	Board  string
+	Name   string
+	Msg    string
+	// Time is when the message was sent. Each message from an origin must
+	// be sent later than the one before it.
+	Time time.Time
+	// Sig is the hex HMAC-SHA256 of the fields above.
+	Sig string
+}
+
+// mac computes the signature of m. Each field is length-prefixed so that
+// no two different messages sign the same bytes.
+func (m *FederatedMessage) mac(secret []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	var n [binary.MaxVarintLen64]byte
+	for _, f := range []string{m.Origin, m.Board, m.Name, m.Msg} {
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(f)))])
+		h.Write([]byte(f))
+	}
+	var at [8]byte
+	binary.BigEndian.PutUint64(at[:], uint64(m.Time.UnixNano()))
+	h.Write(at[:])
+	return h.Sum(nil)
+}
+
+// Sign sets m.Sig for secret. Call it last, once the other fields are set.
+func (m *FederatedMessage) Sign(secret []byte) {
+	m.Sig = hex.EncodeToString(m.mac(secret))
+}
+
+// Verify reports whether m.Sig is right for secret.
+func (m *FederatedMessage) Verify(secret []byte) bool {
+	sig, err := hex.DecodeString(m.Sig)
+	return err == nil && hmac.Equal(sig, m.mac(secret))
+}
+
+// AcceptFederated publishes m, received from a peer, if it is correctly
+// signed with the FederationSecret, meant for this board and not a replay.
+// It appears to clients as coming from "name@origin". Anything else is
+// dropped with an error.
+func (b *Board) AcceptFederated(m FederatedMessage) error {
+	if len(b.cfg.FederationSecret) == 0 {
+		return ErrFederationDisabled
+	}
+	if !m.Verify(b.cfg.FederationSecret) || m.Board != b.Name {
+		return ErrBadSignature
+	}
+	if max := b.cfg.FederationMaxAge; max > 0 && b.cfg.clock().Now().Sub(m.Time) > max {
+		return ErrReplayed
+	}
+	var err error
+	b.query(func() {
+		if !m.Time.After(b.federated[m.Origin]) {
+			err = ErrReplayed
+			return
+		}
+		b.federated[m.Origin] = m.Time
+	})
+	if err != nil {
+		return err
+	}
+	return b.Publish(m.Name+"@"+m.Origin, m.Msg)
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFederatedSignature(t *testing.T) {
+	secret := []byte("shared")
+	cfg := DefaultConfig()
+	cfg.FederationSecret = secret
+	b := startBoard(cfg)
+	alice := make(chan *Notification, 10)
+	b.Login("alice", alice)
+
+	m := FederatedMessage{Origin: "east", Board: "test", Name: "bob", Msg: "hi", Time: time.Now()}
+	m.Sign(secret)
+	if err := b.AcceptFederated(m); err != nil {
+		t.Fatal(err)
+	}
+	if n := recv(t, alice); n.Name != "bob@east" || n.Msg != "hi" {
+		t.Errorf("alice got %+v", n)
+	}
+
+	tampered := m
+	tampered.Msg = "send me your password"
+	wrongKey := m
+	wrongKey.Sign([]byte("guess"))
+	// Moving text between fields must not keep the signature valid.
+	shifted := m
+	shifted.Name, shifted.Msg = "bobh", "i"
+	elsewhere := FederatedMessage{Origin: "east", Board: "other", Name: "bob", Msg: "hi", Time: time.Now()}
+	elsewhere.Sign(secret)
+	later := m
+	later.Time = m.Time.Add(time.Second)
+	for _, bad := range []FederatedMessage{tampered, wrongKey, shifted, elsewhere, later} {
+		if err := b.AcceptFederated(bad); err != ErrBadSignature {
+			t.Errorf("accepted %+v: %v", bad, err)
+		}
+	}
+	b.sync()
+	empty(t, alice)
+
+	off := startBoard(DefaultConfig())
+	if err := off.AcceptFederated(m); err != ErrFederationDisabled {
+		t.Errorf("board without a secret got %v", err)
+	}
+}
+
+func TestFederatedReplay(t *testing.T) {
+	secret := []byte("shared")
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.FederationSecret = secret
+	cfg.FederationMaxAge = time.Minute
+	b := startBoard(cfg)
+	alice := make(chan *Notification, 10)
+	b.Login("alice", alice)
+
+	send := func(origin, msg string, at time.Time) error {
+		m := FederatedMessage{Origin: origin, Board: "test", Name: "bob", Msg: msg, Time: at}
+		m.Sign(secret)
+		return b.AcceptFederated(m)
+	}
+	start := clock.Now()
+	if err := send("east", "one", start); err != nil {
+		t.Fatal(err)
+	}
+	recv(t, alice)
+	// The same message again, or an older one, is a replay.
+	if err := send("east", "one", start); err != ErrReplayed {
+		t.Errorf("repeated message got %v", err)
+	}
+	if err := send("east", "zero", start.Add(-time.Second)); err != ErrReplayed {
+		t.Errorf("older message got %v", err)
+	}
+	// Each peer sends in its own time.
+	if err := send("west", "one", start.Add(-time.Second)); err != nil {
+		t.Errorf("another peer got %v", err)
+	}
+	recv(t, alice)
+
+	clock.Advance(2 * time.Minute)
+	if err := send("north", "late", start); err != ErrReplayed {
+		t.Errorf("stale message got %v", err)
+	}
+	if err := send("east", "two", clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := recv(t, alice); n.Msg != "two" {
+		t.Errorf("alice got %+v", n)
+	}
+	b.sync()
+	empty(t, alice)
+
+	b.Close()
+	if err := send("east", "three", clock.Now().Add(time.Second)); err != ErrBoardClosed {
+		t.Errorf("closed board got %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// flood is one user's recent activity, for flood protection.
+type flood struct {
+	// recent holds when their messages inside the FloodWindow were sent.
+	recent     []time.Time
+	mutedUntil time.Time
+}
+
+// flooding reports whether a message from name at now is to be dropped
+// because name is flooding. The message that goes over the limit mutes them.
+// Runs on the board goroutine.
+func (b *Board) flooding(name string, now time.Time) bool {
+	if b.cfg.FloodMessages <= 0 || b.cfg.FloodWindow <= 0 || b.cfg.FloodMute <= 0 {
+		return false
+	}
+	f := b.floods[name]
+	if f == nil {
+		f = &flood{}
+		b.floods[name] = f
+	}
+	if now.Before(f.mutedUntil) {
+		left := f.mutedUntil.Sub(now).Round(time.Second)
+		b.throttled(name, fmt.Sprintf("you are muted for flooding, %s to go", left), f.mutedUntil)
+		return true
+	}
+	recent := f.recent[:0]
+	for _, t := range f.recent {
+		if now.Sub(t) < b.cfg.FloodWindow {
+			recent = append(recent, t)
+		}
+	}
+	f.recent = append(recent, now)
+	if len(f.recent) <= b.cfg.FloodMessages {
+		return false
+	}
+	f.recent = nil
+	f.mutedUntil = now.Add(b.cfg.FloodMute)
+	fmt.Printf("  muting [%s] for flooding\n", name)
+	b.sendTo(name, alert(fmt.Sprintf("you are muted for %s for flooding", b.cfg.FloodMute)))
+	if b.cfg.ThrottleNoticeWindow > 0 {
+		b.throttle(name, f.mutedUntil).told = now
+	}
+	if b.cfg.FloodNotifyAdmin && b.admin != name {
+		b.sendTo(b.admin, alert(name+" was muted for flooding"))
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFloodMute(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.FloodMessages = 3
+	cfg.FloodWindow = 10 * time.Second
+	cfg.FloodMute = time.Minute
+	cfg.FloodNotifyAdmin = true
+	b := startBoard(cfg)
+	admin := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	// Messages that fall out of the window no longer count.
+	bob.send("one")
+	bob.send("two")
+	admin.expect("bob: one", "bob: two")
+	clock.Advance(10 * time.Second)
+	bob.send("three")
+	bob.send("four")
+	bob.send("five")
+	admin.expect("bob: three", "bob: four", "bob: five")
+	bob.quiet()
+
+	bob.send("six")
+	bob.expect("* you are muted for 1m0s for flooding")
+	admin.expect("* bob was muted for flooding")
+	clock.Advance(20 * time.Second)
+	bob.send("seven")
+	bob.expect("* you are muted for flooding, 40s to go")
+	admin.quiet()
+
+	clock.Advance(40 * time.Second)
+	bob.send("eight")
+	admin.expect("bob: eight")
+	bob.quiet()
+}
+
+func TestFloodMuteThenSlowMode(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.FloodMessages = 2
+	cfg.FloodWindow = time.Minute
+	cfg.FloodMute = 10 * time.Minute
+	cfg.SlowMode = 5 * time.Second
+	cfg.ThrottleNoticeWindow = 5 * time.Second
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+
+	// alice keeps to the slow mode, but not to the flood limit.
+	for _, msg := range []string{"one", "two"} {
+		alice.send(msg)
+		bob.expect("alice: " + msg)
+		clock.Advance(5 * time.Second)
+	}
+	alice.send("three")
+	alice.expect("* you are muted for 10m0s for flooding")
+
+	// bob's wait is over long before alice's.
+	bob.send("four")
+	alice.expect("bob: four")
+	bob.send("five")
+	bob.expect("* slow down, you can send again in 5s")
+	clock.Advance(6 * time.Second)
+	bob.expect("* you can send again")
+	alice.quiet()
+}
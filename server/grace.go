@@ -0,0 +1,66 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// leaveLater holds back name's leave notice until the LeaveGrace is up.
+// Runs on the board goroutine, as do the rest.
+func (b *Board) leaveLater(name string) {
+	if b.gone == nil {
+		b.gone = make(map[string]time.Time)
+	}
+	b.gone[name] = b.cfg.clock().Now().Add(b.cfg.LeaveGrace)
+	if b.graceTimer == nil {
+		b.graceTimer = b.cfg.clock().NewTimer(b.cfg.LeaveGrace)
+	}
+}
+
+// rejoined reports whether name left within the LeaveGrace and had that
+// leave held back, which it now cancels.
+func (b *Board) rejoined(name string) bool {
+	if _, ok := b.gone[name]; !ok {
+		return false
+	}
+	delete(b.gone, name)
+	return true
+}
+
+// graceOver announces the leaves whose grace is up, and waits for the next
+// one due, if any.
+func (b *Board) graceOver() {
+	b.graceTimer = nil
+	now := b.cfg.clock().Now()
+	var due []string
+	var next time.Time
+	for name, at := range b.gone {
+		if !at.After(now) {
+			due = append(due, name)
+		} else if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	sort.Strings(due)
+	for _, name := range due {
+		delete(b.gone, name)
+		b.announcePresence(name, false)
+	}
+	if !next.IsZero() {
+		b.graceTimer = b.cfg.clock().NewTimer(next.Sub(now))
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// Probe checks that the board goroutine is still handling messages, by
+// sending it a PING and waiting up to timeout for the answer. A board that
+// does not answer in time is flagged Unhealthy in its Stats until it answers
+// a later Probe. A closed board is not answering anything, and reports false
+// without being flagged.
+func (b *Board) Probe(timeout time.Duration) bool {
+	t := b.cfg.clock().NewTimer(timeout)
+	defer t.Stop()
+	// Buffered, so that a board that answers late does not block on it.
+	pong := make(chan *Notification, 1)
+	select {
+	case b.wakeupCh <- &Notification{Type: PING, ReplyCh: pong}:
+	case <-b.done:
+		return false
+	case <-t.C():
+		b.wedged(timeout)
+		return false
+	}
+	select {
+	case <-pong:
+		b.unhealthy.Store(false)
+		return true
+	case <-b.done:
+		return false
+	case <-t.C():
+		b.wedged(timeout)
+		return false
+	}
+}
+
+// wedged flags the board as unhealthy.
+func (b *Board) wedged(timeout time.Duration) {
+	if !b.unhealthy.Swap(true) {
+		fmt.Printf("board [%s] did not answer a probe within %s\n", b.Name, timeout)
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait in the tests, so that a bug shows up as a
+// failure rather than a hung test binary.
+const testTimeout = 5 * time.Second
+
+// startBoard returns a running board configured by cfg.
+func startBoard(cfg Config) *Board {
+	b := NewBoardWithConfig("test", cfg)
+	go b.HandleBoard()
+	return b
+}
+
+// sync waits for the board to finish everything sent to it so far. Since
+// the board delivers synchronously, anything it was going to queue for a
+// client is queued by the time sync returns.
+func (b *Board) sync() {
+	b.query(func() {})
+}
+
+// recv returns the next notification on ch.
+func recv(t *testing.T, ch <-chan *Notification) *Notification {
+	t.Helper()
+	select {
+	case n := <-ch:
+		return n
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a notification")
+	}
+	return nil
+}
+
+// empty fails if anything is queued on ch. Call b.sync first.
+func empty(t *testing.T, ch <-chan *Notification) {
+	t.Helper()
+	select {
+	case n := <-ch:
+		t.Fatalf("unexpected notification %+v", n)
+	default:
+	}
+}
+
+// testClient is a client speaking to Serve over an in-memory pipe.
+type testClient struct {
+	t     *testing.T
+	conn  net.Conn
+	lines chan string
+	// unread holds lines that arrived while logging in.
+	unread []string
+}
+
+// connect starts Serve for a new client without logging in.
+func connect(t *testing.T, b *Board) *testClient {
+	t.Helper()
+	srv, cli := net.Pipe()
+	go Serve(b, srv)
+	c := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+	go c.read()
+	t.Cleanup(func() { cli.Close() })
+	return c
+}
+
+// dial connects and logs in as name, returning once the board has the
+// client. Anything sent to the client on login is still there to be read.
+func dial(t *testing.T, b *Board, name string) *testClient {
+	t.Helper()
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send(name)
+	c.unread = c.sync()
+	return c
+}
+
+// read splits the server output into lines. The login prompt, which has no
+// line terminator, is split off as a line of its own.
+func (c *testClient) read() {
+	const prompt = "username> "
+	defer close(c.lines)
+	var pending string
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+		pending += string(buf[:n])
+		for {
+			if strings.HasPrefix(pending, prompt) {
+				c.lines <- prompt
+				pending = pending[len(prompt):]
+			} else if i := strings.IndexByte(pending, '\n'); i >= 0 {
+				c.lines <- strings.TrimRight(pending[:i], "\r")
+				pending = pending[i+1:]
+			} else {
+				break
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatalf("write %q: %v", line, err)
+	}
+}
+
+// next returns the next line from the server.
+func (c *testClient) next() string {
+	c.t.Helper()
+	if len(c.unread) > 0 {
+		line := c.unread[0]
+		c.unread = c.unread[1:]
+		return line
+	}
+	select {
+	case line, ok := <-c.lines:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return line
+	case <-time.After(testTimeout):
+		c.t.Fatal("timed out waiting for a line")
+	}
+	return ""
+}
+
+// expect checks that the next lines from the server are want, in order.
+func (c *testClient) expect(want ...string) {
+	c.t.Helper()
+	for _, w := range want {
+		if got := c.next(); got != w {
+			c.t.Fatalf("got %q, want %q", got, w)
+		}
+	}
+}
+
+// sync makes a round trip through the board and returns whatever was
+// written to the client in the meantime. The reader handles lines in order,
+// so everything the client sent earlier has reached the board by the time
+// sync returns.
+func (c *testClient) sync() []string {
+	c.t.Helper()
+	c.send("/topic")
+	var lines []string
+	for {
+		line := c.next()
+		if line == "* no topic is set" || strings.HasPrefix(line, "* topic: ") {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// quiet checks that nothing was written to the client since the last read.
+func (c *testClient) quiet() {
+	c.t.Helper()
+	if lines := c.sync(); len(lines) > 0 {
+		c.t.Fatalf("unexpected lines %q", lines)
+	}
+}
+
+// closed waits for the server to hang up.
+func (c *testClient) closed() {
+	c.t.Helper()
+	for {
+		select {
+		case _, ok := <-c.lines:
+			if !ok {
+				return
+			}
+		case <-time.After(testTimeout):
+			c.t.Fatal("timed out waiting for the server to hang up")
+		}
+	}
+}
+
+// fakeClock is a Clock that only moves when told to.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	// started, if set, is sent the duration of every new or reset timer.
+	started chan time.Duration
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	when   time.Time
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	t := &fakeTimer{clock: c, c: make(chan time.Time, 1), when: c.now.Add(d), active: true}
+	c.timers = append(c.timers, t)
+	c.mu.Unlock()
+	if c.started != nil {
+		c.started <- d
+	}
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// Advance moves the clock forward by d, firing any timers that come due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, t := range c.timers {
+		if t.active && !t.when.After(c.now) {
+			t.active = false
+			select {
+			case t.c <- c.now:
+			default:
+			}
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	was := t.active
+	t.active = true
+	t.when = t.clock.now.Add(d)
+	t.clock.mu.Unlock()
+	if t.clock.started != nil {
+		t.clock.started <- d
+	}
+	return was
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Message is a published message as kept in a board's history.
+type Message struct {
+	Seq  uint64
+	Time time.Time
+	Name string
+	Msg  string
+	// Parent is the Seq of the message this one replies to, if any.
+	Parent uint64
+}
+
+// notification rebuilds what the board originally sent for m.
+func (m Message) notification() *Notification {
+	return &Notification{
+		Type:   TEXTLINE,
+		Seq:    m.Seq,
+		Time:   m.Time,
+		Name:   m.Name,
+		Msg:    m.Msg,
+		Parent: m.Parent,
+	}
+}
+
+// remember appends m to the history, dropping the oldest message once there
+// are more than HistorySize. Ephemeral messages are never kept.
+func (b *Board) remember(m *Notification) {
+	if b.cfg.HistorySize <= 0 || m.TTL > 0 {
+		return
+	}
+	msg := Message{
+		Seq:    m.Seq,
+		Time:   m.Time,
+		Name:   m.Name,
+		Msg:    m.Msg,
+		Parent: m.Parent,
+	}
+	b.history = append(b.history, msg)
+	if over := len(b.history) - b.cfg.HistorySize; over > 0 {
+		if b.budget != nil {
+			for _, old := range b.history[:over] {
+				b.budget.drop(b, old.Seq)
+			}
+		}
+		b.history = b.history[over:]
+	}
+	if b.budget != nil {
+		b.budget.add(b, msg)
+		b.evict()
+	}
+}
+
+// ClearHistory empties the history, so that later joiners see no backlog,
+// and tells everyone. Only the room admin may clear it.
+func (b *Board) ClearHistory(by string) error {
+	var err error
+	b.query(func() {
+		if by != b.admin {
+			err = ErrNotAdmin
+			return
+		}
+		fmt.Printf("[%s] clears the history of [%s]\n", by, b.Name)
+		b.history = nil
+		if b.budget != nil {
+			b.budget.dropBoard(b)
+		}
+		b.announce(by + " cleared the history")
+	})
+	return err
+}
+
+// inHistory reports whether the message numbered seq is still in the
+// history.
+func (b *Board) inHistory(seq uint64) bool {
+	_, ok := b.message(seq)
+	return ok
+}
+
+// message returns the message numbered seq from the history, if it is still
+// there.
+func (b *Board) message(seq uint64) (Message, bool) {
+	b.evict()
+	i := sort.Search(len(b.history), func(i int) bool { return b.history[i].Seq >= seq })
+	if i < len(b.history) && b.history[i].Seq == seq {
+		return b.history[i], true
+	}
+	return Message{}, false
+}
+
+// replay sends the history, pinned messages and topic to a client that just
+// joined.
+func (b *Board) replay(name string, c *client) {
+	b.evict()
+	for _, m := range b.history {
+		n := m.notification()
+		n.tmpl = b.tmpl
+		for _, f := range b.fragment(n) {
+			b.deliver(name, c, f)
+		}
+	}
+	for _, m := range b.pinned {
+		b.deliver(name, c, notice(pinNotice(m)))
+	}
+	if b.topic != "" {
+		b.deliver(name, c, notice("topic: "+b.topic))
+	}
+}
+
+// BoardSnapshot is the state of a board that can outlive it, suitable for
+// encoding with encoding/json or encoding/gob.
+type BoardSnapshot struct {
+	Name  string
+	Topic string
+	// Seq is the last sequence number the board handed out, which may be
+	// newer than anything left in History.
+	Seq     uint64
+	History []Message
+	// Members were logged in when the snapshot was taken. Restore does not
+	// log them back in, since their connections are gone.
+	Members []string
+}
+
+// Snapshot captures the board's persistent state.
+func (b *Board) Snapshot() BoardSnapshot {
+	var s BoardSnapshot
+	b.query(func() {
+		b.evict()
+		s = BoardSnapshot{
+			Name:    b.Name,
+			Topic:   b.topic,
+			Seq:     b.seq,
+			History: append([]Message(nil), b.history...),
+		}
+		for name := range b.clients {
+			s.Members = append(s.Members, name)
+		}
+		sort.Strings(s.Members)
+	})
+	return s
+}
+
+// Restore builds a new board from a snapshot. The board has no clients and
+// its goroutine is not started. Sequence numbers carry on from where the
+// snapshot left off.
+func Restore(s BoardSnapshot, cfg Config) *Board {
+	b := NewBoardWithConfig(s.Name, cfg)
+	b.topic = s.Topic
+	b.history = append([]Message(nil), s.History...)
+	b.seq = s.Seq
+	return b
+}
@@ -0,0 +1,156 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryReplay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistorySize = 2
+	cfg.FragmentSize = 4
+	b := startBoard(cfg)
+	b.Publish("alice", "one")
+	b.Publish("alice", "two")
+	b.Publish("alice", "three")
+	c := dial(t, b, "bob")
+	// Only the last HistorySize are kept, and they are fragmented as they
+	// were when first sent.
+	c.expect("alice: two", "alice [1/2]: thre", "alice [2/2]: e")
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistorySize = 1
+	b := startBoard(cfg)
+	b.Login("alice", make(chan *Notification, 10))
+	b.SetTopic("alice", "restarts")
+	b.Publish("alice", "one")
+	b.Publish("alice", "two")
+	b.Logout("alice")
+	b.Login("carol", make(chan *Notification, 10))
+	b.Login("bob", make(chan *Notification, 10))
+
+	// The snapshot survives encoding.
+	data, err := json.Marshal(b.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s BoardSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Name != "test" || s.Topic != "restarts" || s.Seq != 2 || len(s.History) != 1 || s.History[0].Msg != "two" {
+		t.Fatalf("snapshot is %+v", s)
+	}
+	if want := []string{"bob", "carol"}; !reflect.DeepEqual(s.Members, want) {
+		t.Errorf("members are %v, want %v", s.Members, want)
+	}
+
+	r := Restore(s, cfg)
+	go r.HandleBoard()
+	if got := r.Snapshot(); !reflect.DeepEqual(got.History, s.History) || got.Topic != s.Topic || got.Members != nil {
+		t.Errorf("restored board is %+v", got)
+	}
+	reply := make(chan *Notification, 10)
+	r.Login("bob", reply)
+	recv(t, reply)
+	recv(t, reply)
+	r.Publish("alice", "three")
+	if n := recv(t, reply); n.Seq != 3 {
+		t.Errorf("new message has seq %d, want 3", n.Seq)
+	}
+}
+
+func TestWriteTranscript(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.HistorySize = 10
+	cfg.Operators = []string{"carol"}
+	b := startBoard(cfg)
+	b.Publish("alice", "one")
+	b.sync()
+	clock.Advance(time.Minute)
+	b.Publish("bob", "two")
+	b.Reply("alice", 2, "three", nil)
+
+	var plain strings.Builder
+	if err := b.WriteTranscript(&plain, "plain"); err != nil {
+		t.Fatal(err)
+	}
+	want := "2017-01-01T00:00:00Z alice: one\n" +
+		"2017-01-01T00:01:00Z bob: two\n" +
+		"2017-01-01T00:01:00Z alice: three\n"
+	if plain.String() != want {
+		t.Errorf("got %q, want %q", plain.String(), want)
+	}
+	var js strings.Builder
+	if err := b.WriteTranscript(&js, "json"); err != nil {
+		t.Fatal(err)
+	}
+	want = `{"seq":1,"time":"2017-01-01T00:00:00Z","name":"alice","text":"one"}
+{"seq":2,"time":"2017-01-01T00:01:00Z","name":"bob","text":"two"}
+{"seq":3,"time":"2017-01-01T00:01:00Z","name":"alice","text":"three","parent":2}
+`
+	if js.String() != want {
+		t.Errorf("got %q, want %q", js.String(), want)
+	}
+	if err := b.WriteTranscript(&js, "xml"); err == nil {
+		t.Error("wrote a transcript in an unknown format")
+	}
+
+	// An operator can read it from the room.
+	op := dial(t, b, "carol")
+	op.unread = nil
+	op.send("/transcript")
+	op.expect("* transcript of test, 3 messages:", "* 2017-01-01T00:00:00Z alice: one")
+	other := dial(t, b, "dave")
+	other.unread = nil
+	other.send("/transcript json")
+	other.expect("* " + ErrNotOperator.Error())
+}
+
+func TestClearHistory(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HistorySize = 10
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	alice.send("one")
+	bob.expect("alice: one")
+
+	bob.send("/clearhistory")
+	bob.expect("* only the room admin can do that")
+	alice.send("/clearhistory")
+	alice.expect("* alice cleared the history")
+	bob.expect("* alice cleared the history")
+	carol := dial(t, b, "carol")
+	carol.quiet()
+	if s := b.Snapshot(); len(s.History) != 0 {
+		t.Errorf("history kept %v", s.History)
+	}
+
+	// What comes after is remembered as usual.
+	alice.send("two")
+	alice.sync()
+	dave := dial(t, b, "dave")
+	dave.expect("alice: two")
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// listen opens the server's TCP listener. Go already sets SO_REUSEADDR on
+// listening sockets, so a restarted server can bind while old connections
+// sit in TIME_WAIT. ReusePort additionally allows several processes to share
+// the address, e.g. an old and a new server during a hand-over.
+func listen(cfg Config) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if cfg.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = setReusePort(fd)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	l, err := lc.Listen(context.Background(), "tcp", cfg.Addr)
+	if err != nil || cfg.Backlog <= 0 {
+		return l, err
+	}
+	// The runtime calls listen(2) itself, with the system maximum, after
+	// Control has run, so the backlog can only be changed once it has.
+	rc, err := l.(*net.TCPListener).SyscallConn()
+	if err == nil {
+		cerr := rc.Control(func(fd uintptr) {
+			err = setBacklog(fd, cfg.Backlog)
+		})
+		if cerr != nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// keepAliver is implemented by connections that support TCP keepalives,
+// such as *net.TCPConn.
+type keepAliver interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// keepAlive applies the KeepAlive setting to conn. Connections that are not
+// TCP are left as they are.
+func keepAlive(conn net.Conn, period time.Duration) error {
+	k, ok := conn.(keepAliver)
+	if !ok || period == 0 {
+		return nil
+	}
+	if period < 0 {
+		return k.SetKeepAlive(false)
+	}
+	if err := k.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return k.SetKeepAlivePeriod(period)
+}
@@ -0,0 +1,231 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestListenReusePort(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "dragonfly", "freebsd", "netbsd", "openbsd":
+	default:
+		t.Skip("SO_REUSEPORT is not supported on " + runtime.GOOS)
+	}
+	cfg := DefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.ReusePort = true
+	cfg.Backlog = 16
+	first, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	// A second listener can share the address.
+	cfg.Addr = first.Addr().String()
+	second, err := listen(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+
+	cfg.ReusePort = false
+	if l, err := listen(cfg); err == nil {
+		l.Close()
+		t.Error("bound a used address without ReusePort")
+	}
+}
+
+// keepAliveConn records the keepalive settings applied to it.
+type keepAliveConn struct {
+	net.Conn
+	on     chan bool
+	period chan time.Duration
+}
+
+func (c *keepAliveConn) SetKeepAlive(on bool) error {
+	c.on <- on
+	return nil
+}
+
+func (c *keepAliveConn) SetKeepAlivePeriod(d time.Duration) error {
+	c.period <- d
+	return nil
+}
+
+func TestAcceptKeepAlive(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.KeepAlive = 30 * time.Second
+	b := startBoard(cfg)
+	l := &scriptedListener{next: make(chan interface{})}
+	go accept(l, b, cfg)
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	conn := &keepAliveConn{Conn: srv, on: make(chan bool, 1), period: make(chan time.Duration, 1)}
+	l.next <- conn
+	if on := <-conn.on; !on {
+		t.Error("keepalive was turned off")
+	}
+	if d := <-conn.period; d != cfg.KeepAlive {
+		t.Errorf("keepalive period %s, want %s", d, cfg.KeepAlive)
+	}
+
+	// Connections without keepalives are served all the same.
+	srv, cli = net.Pipe()
+	defer cli.Close()
+	l.next <- srv
+	c := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+	go c.read()
+	c.expect("username> ")
+}
+
+func TestKeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	srv, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	for _, d := range []time.Duration{time.Minute, -1, 0} {
+		if err := keepAlive(srv, d); err != nil {
+			t.Errorf("keepAlive(%s): %v", d, err)
+		}
+	}
+
+	conn := &keepAliveConn{Conn: srv, on: make(chan bool, 1), period: make(chan time.Duration, 1)}
+	keepAlive(conn, -1)
+	if on := <-conn.on; on {
+		t.Error("a negative period left keepalive on")
+	}
+	keepAlive(conn, 0)
+	select {
+	case <-conn.on:
+		t.Error("a zero period changed the keepalive setting")
+	default:
+	}
+}
+
+func TestServerListenAgain(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	s := NewServer(cfg)
+	if err := s.Listen(cfg); err != nil {
+		t.Fatal(err)
+	}
+	login := func(addr, name string) *testClient {
+		t.Helper()
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &testClient{t: t, conn: conn, lines: make(chan string, 100)}
+		go c.read()
+		t.Cleanup(func() { conn.Close() })
+		c.expect("username> ")
+		c.send(name)
+		c.sync()
+		return c
+	}
+	first := s.Addr().String()
+	alice := login(first, "alice")
+
+	if err := s.Listen(cfg); err != nil {
+		t.Fatal(err)
+	}
+	second := s.Addr().String()
+	if second == first {
+		t.Fatalf("still listening on %s", first)
+	}
+	if conn, err := net.Dial("tcp", first); err == nil {
+		conn.Close()
+		t.Errorf("%s still accepts connections", first)
+	}
+	bob := login(second, "bob")
+
+	// alice, from before the restart, and bob, from after, share the room.
+	alice.send("hi")
+	bob.expect("alice: hi")
+	bob.send("hello")
+	alice.expect("bob: hello")
+
+	done := make(chan error)
+	go func() { done <- s.Wait() }()
+	s.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Wait = %v after Close", err)
+	}
+	alice.expect("* room is closed")
+	alice.closed()
+}
+
+func TestServerShutdown(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration, 100)
+	cfg := DefaultConfig()
+	cfg.Addr = "127.0.0.1:0"
+	cfg.Clock = clock
+	cfg.DrainPeriod = time.Minute
+	cfg.DrainRetryAfter = 10 * time.Second
+	s := NewServer(cfg)
+	if err := s.Listen(cfg); err != nil {
+		t.Fatal(err)
+	}
+	alice := dial(t, s.lobby, "alice")
+	bob := dial(t, s.boards.GetOrCreate("games"), "bob")
+
+	done := make(chan struct{})
+	go func() {
+		s.Shutdown()
+		close(done)
+	}()
+	for _, c := range []*testClient{alice, bob} {
+		c.expect("* server is shutting down", "retry-after 10")
+	}
+	if addr := s.Addr(); addr != nil {
+		t.Errorf("still listening on %s", addr)
+	}
+
+	// Rooms carry on until the drain period is over.
+	for d := time.Duration(0); d != cfg.DrainPeriod; {
+		select {
+		case d = <-clock.started:
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for the drain period to start")
+		}
+	}
+	alice.send("still here")
+	alice.quiet()
+	clock.Advance(cfg.DrainPeriod - time.Second)
+	bob.quiet()
+	clock.Advance(time.Second)
+	for _, c := range []*testClient{alice, bob} {
+		c.expect("* room is closed")
+		c.closed()
+	}
+	<-done
+}
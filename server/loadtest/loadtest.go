@@ -0,0 +1,240 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package loadtest drives a board with simulated clients and reports how
+// quickly their messages get through it.
+package loadtest
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drzaeus77/go-chat-simple/server"
+)
+
+// Size is a message size, in bytes, and how often it is picked relative to
+// the other sizes.
+type Size struct {
+	Bytes  int
+	Weight int
+}
+
+// Options configures a load test. Zero fields take the defaults below.
+type Options struct {
+	// Clients is how many simulated clients log in. Defaults to 10.
+	Clients int
+	// Rate is how many messages each client publishes a second. Defaults
+	// to 10.
+	Rate float64
+	// Duration is how long the clients keep publishing. Defaults to a
+	// second.
+	Duration time.Duration
+	// Drain bounds how long to wait, once publishing stops, for the last
+	// messages to arrive. Defaults to five seconds.
+	Drain time.Duration
+	// Sizes picks the size of every message by weight. Defaults to 64
+	// bytes.
+	Sizes []Size
+	// Seed seeds the random sizes, for repeatable runs.
+	Seed int64
+}
+
+func (o *Options) defaults() {
+	if o.Clients <= 0 {
+		o.Clients = 10
+	}
+	if o.Rate <= 0 {
+		o.Rate = 10
+	}
+	if o.Duration <= 0 {
+		o.Duration = time.Second
+	}
+	if o.Drain <= 0 {
+		o.Drain = 5 * time.Second
+	}
+	if len(o.Sizes) == 0 {
+		o.Sizes = []Size{{Bytes: 64, Weight: 1}}
+	}
+}
+
+// Report is the outcome of a load test.
+type Report struct {
+	// Sent counts the messages published, and Received the copies of them
+	// that reached the other clients. With every client getting every
+	// message, Received is Sent times one less than the number of clients.
+	Sent     int
+	Received int
+	Elapsed  time.Duration
+	// Throughput is Received a second.
+	Throughput float64
+	// Latencies are from publishing a message to another client receiving
+	// it.
+	P50, P90, P99, Max time.Duration
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("sent %d, received %d in %s (%.0f/s), latency p50 %s p90 %s p99 %s max %s",
+		r.Sent, r.Received, r.Elapsed.Round(time.Millisecond), r.Throughput, r.P50, r.P90, r.P99, r.Max)
+}
+
+// prefix marks the messages the load test sends, which carry when they were
+// sent, so that anything else on the board is ignored.
+const prefix = "loadtest "
+
+// Run logs opts.Clients clients in to b, has each publish at opts.Rate for
+// opts.Duration, and reports what got through. b must be running. The
+// clients are logged out again before Run returns.
+func Run(b *server.Board, opts Options) (Report, error) {
+	opts.defaults()
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		sent      int
+		// want is how many copies to expect, once publishing has
+		// stopped, and full is closed when they have all arrived.
+		want = -1
+		full = make(chan struct{})
+	)
+	chans := make([]chan *server.Notification, opts.Clients)
+	names := make([]string, opts.Clients)
+	var readers sync.WaitGroup
+	for i := range chans {
+		names[i] = fmt.Sprintf("load-%d", i)
+		chans[i] = make(chan *server.Notification, 100)
+		if err := b.Login(names[i], chans[i]); err != nil {
+			for _, name := range names[:i] {
+				b.Logout(name)
+			}
+			return Report{}, fmt.Errorf("login %s: %s", names[i], err)
+		}
+		readers.Add(1)
+		go func(ch <-chan *server.Notification) {
+			defer readers.Done()
+			for n := range ch {
+				if n.Type != server.TEXTLINE || !strings.HasPrefix(n.Msg, prefix) {
+					continue
+				}
+				at, err := strconv.ParseInt(strings.Fields(n.Msg[len(prefix):])[0], 10, 64)
+				if err != nil {
+					continue
+				}
+				d := time.Since(time.Unix(0, at))
+				mu.Lock()
+				latencies = append(latencies, d)
+				if len(latencies) == want {
+					close(full)
+				}
+				mu.Unlock()
+			}
+		}(chans[i])
+	}
+
+	start := time.Now()
+	var writers sync.WaitGroup
+	for i, name := range names {
+		writers.Add(1)
+		go func(name string, rnd *rand.Rand) {
+			defer writers.Done()
+			tick := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+			defer tick.Stop()
+			stop := time.After(opts.Duration)
+			for {
+				select {
+				case <-stop:
+					return
+				case <-tick.C:
+				}
+				if b.Publish(name, message(pick(rnd, opts.Sizes))) != nil {
+					return
+				}
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			}
+		}(name, rand.New(rand.NewSource(opts.Seed+int64(i))))
+	}
+	writers.Wait()
+
+	// Wait for the stragglers.
+	mu.Lock()
+	want = sent * (opts.Clients - 1)
+	if len(latencies) >= want {
+		close(full)
+	}
+	mu.Unlock()
+	select {
+	case <-full:
+	case <-time.After(opts.Drain):
+	}
+	elapsed := time.Since(start)
+	for i, name := range names {
+		b.Logout(name)
+		close(chans[i])
+	}
+	readers.Wait()
+
+	r := Report{Sent: sent, Received: len(latencies), Elapsed: elapsed}
+	r.Throughput = float64(r.Received) / elapsed.Seconds()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r.P50 = percentile(latencies, 50)
+	r.P90 = percentile(latencies, 90)
+	r.P99 = percentile(latencies, 99)
+	r.Max = percentile(latencies, 100)
+	return r, nil
+}
+
+// message returns a load test message of size bytes, or the shortest one
+// there can be if size is smaller.
+func message(size int) string {
+	msg := prefix + strconv.FormatInt(time.Now().UnixNano(), 10) + " "
+	if pad := size - len(msg); pad > 0 {
+		msg += strings.Repeat("x", pad)
+	}
+	return msg
+}
+
+// pick chooses one of sizes at random by weight.
+func pick(rnd *rand.Rand, sizes []Size) int {
+	total := 0
+	for _, s := range sizes {
+		total += s.Weight
+	}
+	if total <= 0 {
+		return sizes[0].Bytes
+	}
+	n := rnd.Intn(total)
+	for _, s := range sizes {
+		if n -= s.Weight; n < 0 {
+			return s.Bytes
+		}
+	}
+	return sizes[len(sizes)-1].Bytes
+}
+
+// percentile returns the p'th percentile of sorted.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadtest
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/drzaeus77/go-chat-simple/server"
+)
+
+func TestRun(t *testing.T) {
+	cfg := server.DefaultConfig()
+	cfg.SendQueueSize = 100
+	b := server.NewBoardWithConfig("load", cfg)
+	go b.HandleBoard()
+	defer b.Close()
+
+	opts := Options{
+		Clients:  5,
+		Rate:     100,
+		Duration: 200 * time.Millisecond,
+		Sizes:    []Size{{Bytes: 32, Weight: 3}, {Bytes: 512, Weight: 1}},
+	}
+	r, err := Run(b, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Log(r)
+	if r.Sent == 0 {
+		t.Fatal("nothing was sent")
+	}
+	if want := r.Sent * (opts.Clients - 1); r.Received != want {
+		t.Errorf("received %d, want %d", r.Received, want)
+	}
+	if r.Throughput <= 0 || r.Elapsed < opts.Duration {
+		t.Errorf("throughput %.1f/s over %s", r.Throughput, r.Elapsed)
+	}
+	if r.P50 <= 0 || r.P50 > r.P90 || r.P90 > r.P99 || r.P99 > r.Max || r.Max > r.Elapsed {
+		t.Errorf("latencies out of order: %s", r)
+	}
+	if s := b.Stats(); s.Count != 0 {
+		t.Errorf("clients left behind: %v", s.Members)
+	}
+}
+
+func TestPick(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	sizes := []Size{{Bytes: 10, Weight: 3}, {Bytes: 20, Weight: 1}, {Bytes: 30, Weight: 0}}
+	counts := make(map[int]int)
+	for i := 0; i < 4000; i++ {
+		counts[pick(rnd, sizes)]++
+	}
+	if counts[30] != 0 {
+		t.Errorf("picked a size of no weight %d times", counts[30])
+	}
+	// Three to one, give or take.
+	if counts[10] < 2700 || counts[10] > 3300 {
+		t.Errorf("picked sizes %v", counts)
+	}
+}
+
+func TestMessage(t *testing.T) {
+	if m := message(100); len(m) != 100 {
+		t.Errorf("message of %d bytes, want 100", len(m))
+	}
+	if m := message(1); len(m) <= len(prefix) {
+		t.Errorf("short message %q", m)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRoomLocked is returned by Login while the room is locked.
+var ErrRoomLocked = errors.New("room is locked")
+
+// Lock locks the room, so that nobody new can log in while those already
+// here carry on, or with locked false unlocks it. Logins already waiting
+// for room keep their place in line. Only the room admin may
+// lock and unlock.
+func (b *Board) Lock(by string, locked bool) error {
+	var err error
+	b.query(func() {
+		if by != b.admin {
+			err = ErrNotAdmin
+			return
+		}
+		if b.locked == locked {
+			return
+		}
+		b.locked = locked
+		what := "unlocked"
+		if locked {
+			what = "locked"
+		}
+		fmt.Printf("[%s] %s [%s]\n", by, what, b.Name)
+		b.announce(by + " " + what + " the room")
+		// Anyone who was already waiting for room can come in now.
+		b.admitWaiting()
+	})
+	return err
+}
@@ -0,0 +1,50 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+)
+
+// mentions returns the clients that msg mentions by "@name", leaving out its
+// author. Names of users that are not here are just text.
+func (b *Board) mentions(author, msg string) map[string]bool {
+	var found map[string]bool
+	for _, word := range strings.Fields(msg) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		name := strings.TrimRight(word[1:], `.,:;!?)'"`)
+		if _, ok := b.clients[name]; !ok || name == author {
+			continue
+		}
+		if found == nil {
+			found = make(map[string]bool)
+		}
+		found[name] = true
+	}
+	return found
+}
+
+// ping tells everyone in mentioned that author mentioned them, if the board
+// has MentionPings.
+func (b *Board) ping(author string, mentioned map[string]bool) {
+	if !b.cfg.MentionPings {
+		return
+	}
+	for name := range mentioned {
+		b.tell(name, author+" mentioned you")
+	}
+}
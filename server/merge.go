@@ -0,0 +1,238 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrNoSuchRoom is returned when an operation names a room that does not
+// exist.
+var ErrNoSuchRoom = errors.New("no such room")
+
+// Merge moves every client of the room from into the room into, then closes
+// from. Clients whose name is taken in into get a numbered suffix, as in
+// "bob-2". Nothing a moved client sends is lost: until its session has
+// caught up with the move, from passes its messages on to into. A session
+// catches up the next time its client sends a line; an in-process Client
+// never does, and keeps going through from until it logs out. The goroutine
+// of from exits once every moved client has caught up or left.
+func (r *BoardRegistry) Merge(from, into string) error {
+	if from == into {
+		return errors.New("cannot merge a room into itself")
+	}
+	return r.move(from, into, fmt.Sprintf("room %s was merged into %s", from, into))
+}
+
+// move moves every client of from into into as for Merge, telling each of
+// them why.
+func (r *BoardRegistry) move(from, into, why string) error {
+	r.mu.Lock()
+	src, dst := r.boards[from], r.boards[into]
+	if src == nil || dst == nil {
+		r.mu.Unlock()
+		return ErrNoSuchRoom
+	}
+	delete(r.boards, from)
+	r.mu.Unlock()
+
+	err := ErrBoardClosed
+	var failed bool
+	src.query(func() {
+		err = src.mergeInto(dst, why)
+		failed = err != nil
+	})
+	if failed {
+		// into has gone. Put from back, unless it has been replaced.
+		r.mu.Lock()
+		if _, ok := r.boards[from]; !ok && !r.closed {
+			r.boards[from] = src
+		}
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// mergeInto hands every client to dst and leaves b forwarding for them. Runs
+// on b's goroutine, and waits on dst's; dst never waits on b. Fails with
+// ErrBoardClosed, leaving b as it was, if dst has gone.
+func (b *Board) mergeInto(dst *Board, why string) error {
+	forward := make(map[string]string)
+	ran := false
+	dst.query(func() {
+		ran = true
+		var joined []string
+		for _, old := range sortedNames(b.clients) {
+			name := dst.freeName(old)
+			forward[old] = name
+			joined = append(joined, name)
+			dst.adopt(name, old, b.clients[old], why)
+		}
+		dst.announceBatch(joined, " joined from "+b.Name)
+	})
+	if !ran {
+		return ErrBoardClosed
+	}
+	fmt.Printf("board [%s] merged into [%s]\n", b.Name, dst.Name)
+	b.clients = make(map[string]*client)
+	b.countChanged()
+	for _, m := range b.waiting {
+		m.errCh <- ErrBoardClosed
+	}
+	b.waiting = nil
+	b.mergedInto = dst
+	b.forward = forward
+	b.settled("")
+	return nil
+}
+
+// freeName returns name, or name with the lowest free numbered suffix if a
+// client on the board already has it.
+func (b *Board) freeName(name string) string {
+	if _, ok := b.clients[name]; !ok {
+		return name
+	}
+	for i := 2; ; i++ {
+		if n := fmt.Sprintf("%s-%d", name, i); b.clients[n] == nil {
+			return n
+		}
+	}
+}
+
+// adopt logs in a client moved from another room, where it was called old,
+// keeping its send queue, and tells its session where it now is and why.
+func (b *Board) adopt(name, old string, c *client, why string) {
+	b.joins++
+	c.joined = b.joins
+	b.clients[name] = c
+	b.lastPresence[name] = b.cfg.clock().Now()
+	b.countChanged()
+	b.event(EventLogin, name, "")
+	b.logMembership(name, true)
+	if b.admin == "" {
+		b.admin = name
+	}
+	msg := why
+	if name != old {
+		msg += ", you are now " + name
+	}
+	// Without this the session would keep sending to the old room, so a
+	// client too far behind to be told is hung up on instead.
+	if !b.deliver(name, c, &Notification{
+		Type:     MOVED,
+		Name:     name,
+		Msg:      msg,
+		Priority: PriorityHigh,
+		board:    b,
+	}) {
+		b.hangup(name, c)
+	}
+}
+
+// forwardMerged handles m for a board that has been merged into another, on
+// behalf of the clients that were moved. Sessions stop sending here once
+// they have caught up with the move.
+func (b *Board) forwardMerged(m *Notification) {
+	name, moved := b.forward[m.Name]
+	switch m.Type {
+	case LOGIN:
+		m.errCh <- ErrBoardClosed
+	case LOGOUT:
+		if moved {
+			b.mergedInto.Logout(name)
+			b.settled(m.Name)
+		}
+		b.release(nil, m.left)
+	case TEXTLINE:
+		if moved {
+			b.mergedInto.PublishAck(name, m.Msg, m.AckCh)
+		}
+	case QUERY:
+		m.fn()
+	case PING:
+		m.ReplyCh <- m
+	}
+}
+
+// settled forgets a moved client whose session has caught up, and shuts the
+// board down once there are none left.
+func (b *Board) settled(name string) {
+	delete(b.forward, name)
+	if len(b.forward) == 0 {
+		b.shutdown()
+	}
+}
+
+func sortedNames(clients map[string]*client) []string {
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// seat is where a session's client sits: its board and its name there. Both
+// change when the room is merged into another.
+type seat struct {
+	mu   sync.Mutex
+	b    *Board
+	name string
+	// last is the board the reader last sent to.
+	last *Board
+	old  string
+	// from is the connection the seat is for.
+	from *origin
+}
+
+func (s *seat) get() (*Board, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b, s.name
+}
+
+// move records a MOVED notification from the session's reply channel.
+func (s *seat) move(b *Board, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.b, s.name = b, name
+}
+
+// settle returns where the reader should send to now. The first time that
+// is a new board, the old one is told first, once everything the reader sent
+// it has been passed on, so that nothing is reordered. Only the reader may
+// call settle.
+func (s *seat) settle() (*Board, string) {
+	b, name := s.get()
+	if s.last == nil {
+		s.last, s.old = b, name
+	}
+	if s.last != b {
+		old, oldName := s.last, s.old
+		old.query(func() {
+			old.settled(oldName)
+		})
+		s.last, s.old = b, name
+	}
+	return b, name
+}
+
+func (s *seat) connError(addr string, err error) {
+	b, name := s.get()
+	b.connError(name, addr, err)
+}
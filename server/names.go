@@ -0,0 +1,96 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+// NameGenerator picks the names given to anonymous logins. It is called on
+// the board goroutine with n counting the names that board has asked for,
+// from 1, and is asked again whenever it comes up with a name in use.
+type NameGenerator interface {
+	Name(n int) string
+}
+
+// NameFunc adapts an ordinary function to a NameGenerator.
+type NameFunc func(n int) string
+
+func (f NameFunc) Name(n int) string { return f(n) }
+
+// NumberedNames is the default NameGenerator. It appends n to the prefix,
+// giving "guest-1", "guest-2" and so on for the prefix "guest-".
+type NumberedNames string
+
+func (p NumberedNames) Name(n int) string { return fmt.Sprintf("%s%d", p, n) }
+
+// maxNameTries bounds how often a NameGenerator may come up with a name in
+// use before the board falls back to numbered names, so that a generator
+// with only a few names cannot wedge the board.
+const maxNameTries = 100
+
+// names returns the configured NameGenerator, falling back to numbered
+// guest names.
+func (c *Config) names() NameGenerator {
+	if c.Names == nil {
+		return NumberedNames("guest-")
+	}
+	return c.Names
+}
+
+// truncateName cuts name down to MaxNameLength runes, numbering it if the
+// cut name is in use.
+func (b *Board) truncateName(name string) string {
+	max := b.cfg.MaxNameLength
+	short := truncateRunes(name, max)
+	for i := 2; b.nameInUse(short); i++ {
+		suffix := fmt.Sprintf("-%d", i)
+		short = truncateRunes(name, max-len(suffix)) + suffix
+	}
+	return short
+}
+
+// truncateRunes returns the first n runes of s.
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n <= 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// nameInUse reports whether a client here or waiting to get in is called
+// name, or has it as a nickname.
+func (b *Board) nameInUse(name string) bool {
+	_, ok := b.clients[name]
+	return ok || b.isWaiting(name) || b.nickInUse(name)
+}
+
+// guestName picks an unused name for an anonymous login.
+func (b *Board) guestName() string {
+	gen := b.cfg.names()
+	for tries := 0; ; tries++ {
+		if tries == maxNameTries {
+			gen = NumberedNames("guest-")
+		}
+		b.guests++
+		name := gen.Name(b.guests)
+		if name != "" && !b.nameInUse(name) {
+			return name
+		}
+	}
+}
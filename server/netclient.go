@@ -0,0 +1,244 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotConnected is returned by NetClient.Send while the client is between
+// connections.
+var ErrNotConnected = errors.New("not connected")
+
+// A NetClient redials with a delay that doubles after every failure in a row,
+// up to maxRedialDelay.
+const (
+	minRedialDelay = 50 * time.Millisecond
+	maxRedialDelay = 5 * time.Second
+)
+
+// NetClient is the networked counterpart of Client, for bots that talk to a
+// server over TCP. It speaks the v2 JSON protocol, and whenever the
+// connection drops it dials again with back-off and logs back in under the
+// same name. The server keeps no sessions to resume, so anything sent while
+// the client was away is missed, beyond what the history replays. Messages
+// arrive on C until Close.
+type NetClient struct {
+	Name string
+	C    <-chan *Notification
+
+	addr   string
+	ch     chan *Notification
+	mu     sync.Mutex
+	conn   net.Conn
+	closed chan struct{}
+	done   chan struct{}
+}
+
+// DialClient connects to the server at addr and logs in as name. The first
+// login must succeed; after that the client keeps itself connected.
+func DialClient(addr, name string) (*NetClient, error) {
+	c := &NetClient{
+		Name:   name,
+		addr:   addr,
+		ch:     make(chan *Notification, 100),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	c.C = c.ch
+	conn, r, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	go c.run(conn, r)
+	return c, nil
+}
+
+// dial connects and logs in, returning the connection and a reader
+// positioned after the login.
+func (c *NetClient) dial() (net.Conn, *bufio.Reader, error) {
+	conn, err := net.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	r, err := c.login(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, r, nil
+}
+
+// login switches conn to the JSON protocol, asks to be told when the login
+// has succeeded, and logs in.
+func (c *NetClient) login(conn net.Conn) (*bufio.Reader, error) {
+	r := bufio.NewReader(conn)
+	prompt := make([]byte, len("username> "))
+	if _, err := io.ReadFull(r, prompt); err != nil {
+		return nil, err
+	}
+	for _, line := range []string{"VERSION 2", "CAPS welcome"} {
+		if _, err := fmt.Fprintf(conn, "%s\n", line); err != nil {
+			return nil, err
+		}
+		if m, err := readJSON(r); err != nil {
+			return nil, err
+		} else if m.Type != "prompt" {
+			return nil, fmt.Errorf("unexpected %q from the server", m.Text)
+		}
+	}
+	if _, err := fmt.Fprintf(conn, "%s\n", c.Name); err != nil {
+		return nil, err
+	}
+	m, err := readJSON(r)
+	if err != nil {
+		return nil, err
+	}
+	if m.Type != "notice" || m.Text != "you are "+c.Name {
+		return nil, errors.New(m.Text)
+	}
+	return r, nil
+}
+
+// run reads from conn until it fails, then dials again, until Close.
+func (c *NetClient) run(conn net.Conn, r *bufio.Reader) {
+	defer close(c.done)
+	var delay time.Duration
+	for {
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+		err := c.read(r)
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+		for {
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+			fmt.Printf("client [%s]: %s, redialing\n", c.Name, err)
+			if delay == 0 {
+				delay = minRedialDelay
+			} else if delay *= 2; delay > maxRedialDelay {
+				delay = maxRedialDelay
+			}
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(delay):
+			}
+			if conn, r, err = c.dial(); err == nil {
+				delay = 0
+				break
+			}
+		}
+	}
+}
+
+// read passes on everything from r until it fails.
+func (c *NetClient) read(r *bufio.Reader) error {
+	for {
+		m, err := readJSON(r)
+		if err != nil {
+			return err
+		}
+		select {
+		case c.ch <- m.notification():
+		case <-c.closed:
+			return errors.New("closed")
+		}
+	}
+}
+
+// readJSON reads one JSON line from r.
+func readJSON(r *bufio.Reader) (jsonMessage, error) {
+	var m jsonMessage
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal([]byte(strings.TrimSpace(line)), &m)
+	return m, err
+}
+
+// notification converts a message in the JSON protocol back to what the
+// board sent.
+func (m jsonMessage) notification() *Notification {
+	n := &Notification{
+		Name:    m.Name,
+		Msg:     m.Text,
+		Seq:     m.Seq,
+		Part:    m.Part,
+		Parts:   m.Parts,
+		Parent:  m.Parent,
+		Mention: m.Mention,
+		TTL:     time.Duration(m.TTL) * time.Second,
+		Nick:    m.Nick,
+	}
+	if m.Time != "" {
+		n.Time, _ = time.Parse(time.RFC3339, m.Time)
+	}
+	switch m.Type {
+	case "ack":
+		n.Type = ACK
+	case "notice":
+		n.Type = NOTICE
+	case "direct":
+		n.Type = DIRECT
+	case "redacted":
+		n.Type = REDACTED
+	case "typing":
+		n.Type = TYPING
+	default:
+		n.Type = TEXTLINE
+	}
+	return n
+}
+
+// Send publishes msg, or fails with ErrNotConnected if the client is
+// between connections.
+func (c *NetClient) Send(msg string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return ErrNotConnected
+	}
+	_, err := fmt.Fprintf(c.conn, "%s\n", msg)
+	return err
+}
+
+// Close logs the client out, hanging up for good, and closes C.
+func (c *NetClient) Close() {
+	close(c.closed)
+	c.mu.Lock()
+	if c.conn != nil {
+		fmt.Fprintf(c.conn, "/quit\n")
+		c.conn.Close()
+	}
+	c.mu.Unlock()
+	<-c.done
+	close(c.ch)
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// ErrNickInUse is returned by SetNick for a nickname that someone else is
+// logged in as, or is already using.
+var ErrNickInUse = errors.New("that nickname is in use")
+
+// SetNick gives the client logged in as name a nickname, which is shown on
+// its messages in place of name. Everything else, private messages and
+// moderation included, still goes by name. Setting the nickname to name, or
+// to nothing, clears it.
+func (b *Board) SetNick(name, nick string) error {
+	var err error
+	b.query(func() {
+		c := b.clients[name]
+		if c == nil {
+			err = ErrNoSuchUser
+			return
+		}
+		if nick == name {
+			nick = ""
+		}
+		if nick == c.nick {
+			return
+		}
+		if nick != "" {
+			if max := b.cfg.MaxNameLength; max > 0 && utf8.RuneCountInString(nick) > max {
+				err = ErrNameTooLong
+				return
+			}
+			if b.nameInUse(nick) {
+				err = ErrNickInUse
+				return
+			}
+		}
+		fmt.Printf("nick for [%s] changed to [%s]\n", name, nick)
+		old := display(name, c.nick)
+		c.nick = nick
+		b.announce(old + " is now known as " + display(name, nick))
+	})
+	return err
+}
+
+// Nick returns the nickname of the client logged in as name, if it has one.
+func (b *Board) Nick(name string) string {
+	var nick string
+	b.query(func() {
+		if c := b.clients[name]; c != nil {
+			nick = c.nick
+		}
+	})
+	return nick
+}
+
+// nickInUse reports whether a client here goes by nick.
+func (b *Board) nickInUse(nick string) bool {
+	for _, c := range b.clients {
+		if c.nick == nick {
+			return true
+		}
+	}
+	return false
+}
+
+// display is the name shown for name with the nickname nick.
+func display(name, nick string) string {
+	if nick != "" {
+		return nick
+	}
+	return name
+}
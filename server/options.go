@@ -0,0 +1,82 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "time"
+
+// BoardOption changes one setting of the Config a board is built with, for
+// NewBoardWithOptions.
+type BoardOption func(*Config)
+
+// NewBoardWithOptions returns a board with the default configuration as
+// changed by opts, applied in order.
+func NewBoardWithOptions(name string, opts ...BoardOption) *Board {
+	cfg := DefaultConfig()
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return NewBoardWithConfig(name, cfg)
+}
+
+// WithBoardConfig replaces every board setting with bc.
+func WithBoardConfig(bc BoardConfig) BoardOption {
+	return func(c *Config) { c.BoardConfig = bc }
+}
+
+// WithConfig replaces the whole configuration with cfg, for options that
+// follow to adjust.
+func WithConfig(cfg Config) BoardOption {
+	return func(c *Config) { *c = cfg }
+}
+
+// WithHistorySize sets BoardConfig.HistorySize.
+func WithHistorySize(n int) BoardOption {
+	return func(c *Config) { c.HistorySize = n }
+}
+
+// WithMaxClients sets BoardConfig.MaxClients.
+func WithMaxClients(n int) BoardOption {
+	return func(c *Config) { c.MaxClients = n }
+}
+
+// WithSendQueueSize sets BoardConfig.SendQueueSize.
+func WithSendQueueSize(n int) BoardOption {
+	return func(c *Config) { c.SendQueueSize = n }
+}
+
+// WithSlowMode sets BoardConfig.SlowMode.
+func WithSlowMode(d time.Duration) BoardOption {
+	return func(c *Config) { c.SlowMode = d }
+}
+
+// WithOnCountChange sets Config.OnCountChange.
+func WithOnCountChange(fn func(board string, n int)) BoardOption {
+	return func(c *Config) { c.OnCountChange = fn }
+}
+
+// WithEvents sets Config.Events, which records what happens on the board.
+func WithEvents(e *EventStream) BoardOption {
+	return func(c *Config) { c.Events = e }
+}
+
+// WithClock sets Config.Clock.
+func WithClock(clock Clock) BoardOption {
+	return func(c *Config) { c.Clock = clock }
+}
+
+// WithNames sets Config.Names.
+func WithNames(names NameGenerator) BoardOption {
+	return func(c *Config) { c.Names = names }
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewBoardWithOptions(t *testing.T) {
+	clock := newFakeClock()
+	events := NewEventStream(10, false)
+	counts := make(chan int, 10)
+	b := NewBoardWithOptions("opts",
+		WithHistorySize(1),
+		WithMaxClients(1),
+		WithSendQueueSize(4),
+		WithSlowMode(time.Minute),
+		WithOnCountChange(func(board string, n int) { counts <- n }),
+		WithEvents(events),
+		WithClock(clock),
+	)
+	go b.HandleBoard()
+	defer b.Close()
+
+	b.Publish("bob", "old")
+	b.Publish("dave", "new")
+	alice, err := Connect(b, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := cap(alice.C); n != 4 {
+		t.Errorf("send queue of %d", n)
+	}
+	// Only the newest message is replayed.
+	if n := recv(t, alice.C); n.Msg != "new" {
+		t.Errorf("replayed %+v", n)
+	}
+	if err := b.Login("carol", make(chan *Notification, 10)); err != ErrRoomFull {
+		t.Errorf("second login got %v", err)
+	}
+	if n := <-counts; n != 1 {
+		t.Errorf("count %d", n)
+	}
+	b.Publish("dave", "too soon")
+	b.sync()
+	empty(t, alice.C)
+	for e := range events.C {
+		if e.Type == EventLogin {
+			if !e.Time.Equal(clock.Now()) || e.Board != "opts" {
+				t.Errorf("login event %+v", e)
+			}
+			break
+		}
+	}
+}
+
+func TestNewBoardKeepsBoardConfig(t *testing.T) {
+	b := NewBoard("plain", BoardConfig{HistorySize: 3})
+	if b.cfg.HistorySize != 3 || b.cfg.FlushTimeout != DefaultConfig().FlushTimeout {
+		t.Errorf("config %+v", b.cfg)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "sync"
+
+// outbox is a client's own queue of notifications, delivered in order by a
+// goroutine of its own so that a slow client holds up nobody but itself.
+// Used with DeliveryWorkers.
+type outbox struct {
+	mu    sync.Mutex
+	queue []*Notification
+	// urgent holds PriorityHigh notifications, which go first.
+	urgent []*Notification
+	closed bool
+	// left, if set when the outbox is closed, is closed in turn once the
+	// last notification has been handed over.
+	left chan struct{}
+	// wake has room for one pending signal that the queue changed.
+	wake chan struct{}
+}
+
+// newOutbox starts delivering to ch.
+func newOutbox(ch chan<- *Notification) *outbox {
+	o := &outbox{wake: make(chan struct{}, 1)}
+	go o.run(ch)
+	return o
+}
+
+func (o *outbox) push(n *Notification) {
+	o.mu.Lock()
+	if n.Priority == PriorityHigh {
+		o.urgent = append(o.urgent, n)
+	} else {
+		o.queue = append(o.queue, n)
+	}
+	o.mu.Unlock()
+	o.signal()
+}
+
+// len is how many normal notifications are waiting to be handed over.
+func (o *outbox) len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.queue)
+}
+
+// dropOldest throws away the normal notification that has waited longest,
+// if any.
+func (o *outbox) dropOldest() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if len(o.queue) > 0 {
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+	}
+}
+
+// close stops the goroutine once it has handed over everything queued, and
+// then closes left if it is set.
+func (o *outbox) close(left chan struct{}) {
+	o.mu.Lock()
+	o.closed = true
+	o.left = left
+	o.mu.Unlock()
+	o.signal()
+}
+
+func (o *outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *outbox) run(ch chan<- *Notification) {
+	for {
+		o.mu.Lock()
+		var n *Notification
+		switch {
+		case len(o.urgent) > 0:
+			n = o.urgent[0]
+			o.urgent[0] = nil
+			o.urgent = o.urgent[1:]
+		case len(o.queue) > 0:
+			n = o.queue[0]
+			o.queue[0] = nil
+			o.queue = o.queue[1:]
+		default:
+			closed, left := o.closed, o.left
+			o.mu.Unlock()
+			if closed {
+				if left != nil {
+					close(left)
+				}
+				return
+			}
+			<-o.wake
+			continue
+		}
+		o.mu.Unlock()
+		ch <- n
+	}
+}
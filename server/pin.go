@@ -0,0 +1,81 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Pin pins the message numbered seq, which must still be in the history, so
+// that everyone joining later is shown it, or with pin false unpins it. Only
+// the room admin may pin and unpin.
+func (b *Board) Pin(by string, seq uint64, pin bool) error {
+	var err error
+	b.query(func() {
+		if by != b.admin {
+			err = ErrNotAdmin
+			return
+		}
+		if !pin {
+			if !b.unpin(seq) {
+				err = ErrNoSuchMessage
+				return
+			}
+			fmt.Printf("[%s] unpins #%d\n", by, seq)
+			b.announce(fmt.Sprintf("%s unpinned message #%d", by, seq))
+			return
+		}
+		m, ok := b.message(seq)
+		if !ok {
+			err = ErrNoSuchMessage
+			return
+		}
+		i := sort.Search(len(b.pinned), func(i int) bool { return b.pinned[i].Seq >= seq })
+		if i < len(b.pinned) && b.pinned[i].Seq == seq {
+			return
+		}
+		fmt.Printf("[%s] pins #%d\n", by, seq)
+		b.pinned = append(b.pinned[:i:i], append([]Message{m}, b.pinned[i:]...)...)
+		b.announce(fmt.Sprintf("%s pinned message #%d", by, seq))
+	})
+	return err
+}
+
+// Pins returns the pinned messages, oldest first.
+func (b *Board) Pins() []Message {
+	var pins []Message
+	b.query(func() {
+		pins = append(pins, b.pinned...)
+	})
+	return pins
+}
+
+// unpin forgets the pinned message numbered seq, reporting whether it was
+// pinned.
+func (b *Board) unpin(seq uint64) bool {
+	for i, m := range b.pinned {
+		if m.Seq == seq {
+			b.pinned = append(b.pinned[:i:i], b.pinned[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// pinNotice is how a pinned message is shown.
+func pinNotice(m Message) string {
+	return fmt.Sprintf("pinned #%d %s: %s", m.Seq, m.Name, m.Msg)
+}
@@ -0,0 +1,390 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// Every connection starts out speaking the original line protocol, and is
+// sent its login prompt straight away. A client may answer that first prompt
+// with "VERSION <n>" instead of a name to switch to another wire protocol,
+// after which it is prompted again in the new one. Existing clients keep
+// working unchanged and never wait on a handshake.
+//
+//	1 - plain text lines (default)
+//	2 - one JSON object per line
+//	3 - frames of a 4 byte big-endian length followed by a text line
+const versionPrefix = "VERSION "
+
+// protocol is the wire format spoken with one client.
+type protocol interface {
+	// ReadLine returns the next line of input, without its terminator.
+	ReadLine() (string, error)
+	// Prompt asks the client for input and flushes.
+	Prompt(text string) error
+	// WriteLine sends a line of server text outside of any board traffic.
+	WriteLine(text string) error
+	// WriteNotification renders one notification from the board.
+	WriteNotification(n *Notification) error
+	// SetFormat picks one of formats for the notifications that follow.
+	SetFormat(name string) error
+	// Restyle takes on the choices of r that belong to the board, for a
+	// client that has moved to another one. The format the client picked
+	// for itself is kept.
+	Restyle(r render)
+	Flush() error
+}
+
+// formats are the ways a client can ask to be shown messages, with /format.
+// Each connection picks its own, whatever others on the board use.
+//
+//	plain       - "alice: hello" (default)
+//	timestamped - "[15:04:05] alice: hello"
+//	json        - the v2 JSON objects, within the connection's framing
+var formats = []string{"plain", "timestamped", "json"}
+
+// handshake reports whether line, the reply to the first prompt, asks for a
+// protocol version rather than giving a name. Unknown versions get v1.
+func handshake(line string, reader *bufio.Reader, writer *bufio.Writer, r render) (protocol, bool) {
+	if !strings.HasPrefix(line, versionPrefix) {
+		return nil, false
+	}
+	switch strings.TrimSpace(strings.TrimPrefix(line, versionPrefix)) {
+	case "2":
+		return &jsonProtocol{reader: reader, writer: writer}, true
+	case "3":
+		return &framedProtocol{reader: reader, writer: writer, render: r}, true
+	}
+	return &lineProtocol{reader: reader, writer: writer, render: r}, true
+}
+
+// render holds the choices about how the text protocols show messages.
+type render struct {
+	// seq prefixes messages with their board sequence number, so that
+	// clients can spot ones that were dropped.
+	seq bool
+	// color draws sender names in ANSI colors.
+	color bool
+	// timestamp prefixes messages with when the board accepted them.
+	timestamp bool
+	// json renders notifications as jsonMessage objects instead.
+	json bool
+	// crlf ends lines with "\r\n" instead of "\n".
+	crlf bool
+}
+
+// boardRender returns the render choices cfg makes for everyone on a board.
+func boardRender(cfg *BoardConfig) render {
+	return render{seq: cfg.ShowSeq, color: cfg.ColorNames, crlf: cfg.CRLF}
+}
+
+// restyle takes on the board's choices from board, keeping r's own.
+func (r *render) restyle(board render) {
+	r.seq, r.color, r.crlf = board.seq, board.color, board.crlf
+}
+
+// eol returns the line terminator r writes.
+func (r render) eol() string {
+	if r.crlf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// setFormat switches r to the named format.
+func (r *render) setFormat(name string) error {
+	switch name {
+	case "plain":
+		r.timestamp, r.json = false, false
+	case "timestamped":
+		r.timestamp, r.json = true, false
+	case "json":
+		r.timestamp, r.json = false, true
+	default:
+		return fmt.Errorf("unknown format %q, try one of: %s", name, strings.Join(formats, " "))
+	}
+	return nil
+}
+
+// format renders a notification as a single line of text, without a
+// terminator.
+func (r render) format(n *Notification) string {
+	if r.json {
+		data, _ := json.Marshal(jsonLine(n))
+		return string(data)
+	}
+	switch n.Type {
+	case ACK:
+		return fmt.Sprintf("ack %d", n.Seq)
+	case NOTICE:
+		return fmt.Sprintf("* %s", n.Msg)
+	case REDACTED:
+		return fmt.Sprintf("* message #%d was redacted", n.Seq)
+	case TYPING:
+		return fmt.Sprintf("* %s is typing", n.Name)
+	}
+	if n.tmpl != nil && n.Type == TEXTLINE {
+		if line, ok := execute(n.tmpl, n); ok {
+			return line
+		}
+	}
+	var prefix string
+	if r.timestamp && !n.Time.IsZero() {
+		prefix = n.Time.Format("[15:04:05] ")
+	}
+	if r.seq {
+		prefix += fmt.Sprintf("#%d ", n.Seq)
+	}
+	if n.Mention {
+		prefix = "! " + prefix
+	}
+	name := display(n.Name, n.Nick)
+	if n.own {
+		name = "you"
+	} else if r.color {
+		name = colorName(name)
+	}
+	if n.Parent != 0 {
+		name += fmt.Sprintf(" (re #%d)", n.Parent)
+	}
+	if n.Type == DIRECT {
+		return fmt.Sprintf("%s%s (private): %s", prefix, name, n.Msg)
+	}
+	if n.Parts > 0 {
+		return fmt.Sprintf("%s%s [%d/%d]: %s", prefix, name, n.Part, n.Parts, n.Msg)
+	}
+	return fmt.Sprintf("%s%s: %s", prefix, name, n.Msg)
+}
+
+// lineProtocol is v1, newline terminated text.
+type lineProtocol struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	render render
+}
+
+func (p *lineProtocol) ReadLine() (string, error) {
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (p *lineProtocol) Prompt(text string) error {
+	if _, err := p.writer.WriteString(text + "> "); err != nil {
+		return err
+	}
+	return p.writer.Flush()
+}
+
+func (p *lineProtocol) WriteLine(text string) error {
+	_, err := p.writer.WriteString(text + p.render.eol())
+	return err
+}
+
+func (p *lineProtocol) WriteNotification(n *Notification) error {
+	return p.WriteLine(p.render.format(n))
+}
+
+func (p *lineProtocol) SetFormat(name string) error {
+	return p.render.setFormat(name)
+}
+
+func (p *lineProtocol) Restyle(r render) {
+	p.render.restyle(r)
+}
+
+func (p *lineProtocol) Flush() error {
+	return p.writer.Flush()
+}
+
+// jsonProtocol is v2. Client lines are objects with a "text" member; lines
+// that are not JSON are taken as text. Server lines are jsonMessage objects,
+// which always carry the sequence number.
+type jsonProtocol struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+type jsonMessage struct {
+	Type    string `json:"type"`
+	Name    string `json:"name,omitempty"`
+	Text    string `json:"text,omitempty"`
+	Seq     uint64 `json:"seq,omitempty"`
+	Part    int    `json:"part,omitempty"`
+	Parts   int    `json:"parts,omitempty"`
+	Time    string `json:"time,omitempty"`
+	Parent  uint64 `json:"parent,omitempty"`
+	Mention bool   `json:"mention,omitempty"`
+	// TTL is in seconds.
+	TTL  int    `json:"ttl,omitempty"`
+	Nick string `json:"nick,omitempty"`
+}
+
+// jsonLine converts a notification from the board to its JSON form.
+func jsonLine(n *Notification) jsonMessage {
+	m := jsonMessage{
+		Name:    n.Name,
+		Text:    n.Msg,
+		Seq:     n.Seq,
+		Part:    n.Part,
+		Parts:   n.Parts,
+		Parent:  n.Parent,
+		Mention: n.Mention,
+		TTL:     int(n.TTL / time.Second),
+		Nick:    n.Nick,
+	}
+	if !n.Time.IsZero() {
+		m.Time = n.Time.Format(time.RFC3339)
+	}
+	switch n.Type {
+	case ACK:
+		m.Type = "ack"
+	case NOTICE:
+		m.Type = "notice"
+	case DIRECT:
+		m.Type = "direct"
+	case REDACTED:
+		m.Type = "redacted"
+	case TYPING:
+		m.Type = "typing"
+	default:
+		m.Type = "message"
+	}
+	return m
+}
+
+func (p *jsonProtocol) ReadLine() (string, error) {
+	line, err := p.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	var in struct {
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal([]byte(line), &in); err != nil {
+		return line, nil
+	}
+	return in.Text, nil
+}
+
+func (p *jsonProtocol) write(m jsonMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := p.writer.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (p *jsonProtocol) Prompt(text string) error {
+	if err := p.write(jsonMessage{Type: "prompt", Text: text}); err != nil {
+		return err
+	}
+	return p.writer.Flush()
+}
+
+func (p *jsonProtocol) WriteLine(text string) error {
+	return p.write(jsonMessage{Type: "notice", Text: text})
+}
+
+func (p *jsonProtocol) WriteNotification(n *Notification) error {
+	return p.write(jsonLine(n))
+}
+
+// SetFormat only accepts json, which v2 always speaks.
+func (p *jsonProtocol) SetFormat(name string) error {
+	if name != "json" {
+		return errors.New("this connection only speaks json")
+	}
+	return nil
+}
+
+// Restyle has nothing to do, since JSON leaves showing messages to the
+// client.
+func (p *jsonProtocol) Restyle(r render) {}
+
+func (p *jsonProtocol) Flush() error {
+	return p.writer.Flush()
+}
+
+// framedProtocol is v3: each line in either direction is sent as a 4 byte
+// big-endian length followed by that many bytes of text.
+type framedProtocol struct {
+	reader *bufio.Reader
+	writer *bufio.Writer
+	render render
+}
+
+// maxFrame bounds the allocation a client can force with a bogus length.
+const maxFrame = 64 * 1024
+
+func (p *framedProtocol) ReadLine() (string, error) {
+	var size uint32
+	if err := binary.Read(p.reader, binary.BigEndian, &size); err != nil {
+		return "", err
+	}
+	if size > maxFrame {
+		return "", fmt.Errorf("frame of %d bytes exceeds %d", size, maxFrame)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(p.reader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (p *framedProtocol) Prompt(text string) error {
+	if err := p.WriteLine(text); err != nil {
+		return err
+	}
+	return p.writer.Flush()
+}
+
+func (p *framedProtocol) WriteLine(text string) error {
+	if err := binary.Write(p.writer, binary.BigEndian, uint32(len(text))); err != nil {
+		return err
+	}
+	_, err := p.writer.WriteString(text)
+	return err
+}
+
+func (p *framedProtocol) WriteNotification(n *Notification) error {
+	return p.WriteLine(p.render.format(n))
+}
+
+func (p *framedProtocol) SetFormat(name string) error {
+	return p.render.setFormat(name)
+}
+
+func (p *framedProtocol) Restyle(r render) {
+	p.render.restyle(r)
+}
+
+func (p *framedProtocol) Flush() error {
+	return p.writer.Flush()
+}
@@ -0,0 +1,271 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShowSeq(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ShowSeq = true
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+
+	b.Publish("bob", "hi")
+	b.Publish("bob", "again")
+	c.expect("#1 bob: hi", "#2 bob: again")
+	// The counter is per board, not per client.
+	d := dial(t, b, "carol")
+	b.Publish("bob", "both")
+	c.expect("#3 bob: both")
+	d.expect("#3 bob: both")
+}
+
+func TestRenderFormat(t *testing.T) {
+	at := time.Date(2017, 1, 1, 13, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		r    render
+		n    Notification
+		want string
+	}{
+		{render{}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", Seq: 4}, "a: hi"},
+		{render{seq: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", Seq: 4}, "#4 a: hi"},
+		{render{seq: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", Seq: 4, Part: 1, Parts: 2}, "#4 a [1/2]: hi"},
+		{render{seq: true}, Notification{Type: NOTICE, Msg: "hello"}, "* hello"},
+		{render{seq: true}, Notification{Type: ACK, Seq: 4}, "ack 4"},
+		{render{timestamp: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", Seq: 4, Time: at}, "[13:04:05] a: hi"},
+		{render{timestamp: true, seq: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", Seq: 4, Time: at}, "[13:04:05] #4 a: hi"},
+		{render{timestamp: true}, Notification{Type: NOTICE, Msg: "hello"}, "* hello"},
+		{render{json: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", Seq: 4, Time: at}, `{"type":"message","name":"a","text":"hi","seq":4,"time":"2017-01-01T13:04:05Z"}`},
+		{render{json: true}, Notification{Type: NOTICE, Msg: "hello"}, `{"type":"notice","text":"hello"}`},
+		{render{seq: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "yes", Seq: 5, Parent: 4}, "#5 a (re #4): yes"},
+		{render{json: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "yes", Seq: 5, Parent: 4}, `{"type":"message","name":"a","text":"yes","seq":5,"parent":4}`},
+		{render{seq: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "@b hi", Seq: 4, Mention: true}, "! #4 a: @b hi"},
+		{render{color: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", own: true}, "you: hi"},
+		{render{seq: true}, Notification{Type: REDACTED, Seq: 4}, "* message #4 was redacted"},
+		{render{json: true}, Notification{Type: REDACTED, Seq: 4}, `{"type":"redacted","seq":4}`},
+		{render{}, Notification{Type: TYPING, Name: "a"}, "* a is typing"},
+		{render{json: true}, Notification{Type: TYPING, Name: "a"}, `{"type":"typing","name":"a"}`},
+		{render{json: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "hi", own: true}, `{"type":"message","name":"a","text":"hi"}`},
+		{render{json: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "@b hi", Mention: true}, `{"type":"message","name":"a","text":"@b hi","mention":true}`},
+		{render{}, Notification{Type: TEXTLINE, Name: "a", Msg: "soon gone", TTL: time.Minute}, "a: soon gone"},
+		{render{json: true}, Notification{Type: TEXTLINE, Name: "a", Msg: "soon gone", TTL: time.Minute}, `{"type":"message","name":"a","text":"soon gone","ttl":60}`},
+		{render{}, Notification{Type: TEXTLINE, Name: "a", Nick: "Al", Msg: "hi"}, "Al: hi"},
+		{render{json: true}, Notification{Type: TEXTLINE, Name: "a", Nick: "Al", Msg: "hi"}, `{"type":"message","name":"a","text":"hi","nick":"Al"}`},
+	} {
+		if got := tc.r.format(&tc.n); got != tc.want {
+			t.Errorf("format(%+v) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestJSONProtocol(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Clock = newFakeClock()
+	b := startBoard(cfg)
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("VERSION 2")
+	c.expect(`{"type":"prompt","text":"username"}`)
+	c.send(`{"text":"alice"}`)
+	c.send(`{"text":"/topic"}`)
+	c.expect(`{"type":"notice","text":"no topic is set"}`)
+	b.Publish("bob", "hi")
+	c.expect(`{"type":"message","name":"bob","text":"hi","seq":1,"time":"2017-01-01T00:00:00Z"}`)
+}
+
+func TestFramedProtocol(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go Serve(b, srv)
+	r := bufio.NewReader(cli)
+	p := &framedProtocol{reader: r, writer: bufio.NewWriter(cli)}
+
+	prompt := make([]byte, len("username> "))
+	if _, err := io.ReadFull(r, prompt); err != nil || string(prompt) != "username> " {
+		t.Fatalf("read %q, %v", prompt, err)
+	}
+	if _, err := cli.Write([]byte("VERSION 3\n")); err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want string) {
+		t.Helper()
+		if line, err := p.ReadLine(); err != nil || line != want {
+			t.Fatalf("got %q, %v, want %q", line, err, want)
+		}
+	}
+	expect("username")
+	p.WriteLine("alice")
+	p.WriteLine("/topic framed")
+	p.Flush()
+	expect("* alice set the topic: framed")
+}
+
+func TestUnknownVersionIsLine(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("VERSION 9")
+	c.expect("username> ")
+	c.send("alice")
+	c.quiet()
+}
+
+func TestFormatPerClient(t *testing.T) {
+	clock := newFakeClock()
+	clock.Advance(13*time.Hour + 4*time.Minute + 5*time.Second)
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	plain := dial(t, b, "alice")
+	stamped := dial(t, b, "bob")
+	js := dial(t, b, "carol")
+	stamped.send("/format timestamped")
+	stamped.expect("* format is now timestamped")
+	js.send("/format json")
+	js.expect(`{"type":"notice","text":"format is now json"}`)
+
+	b.Publish("dave", "hi")
+	plain.expect("dave: hi")
+	stamped.expect("[13:04:05] dave: hi")
+	js.expect(`{"type":"message","name":"dave","text":"hi","seq":1,"time":"2017-01-01T13:04:05Z"}`)
+
+	plain.send("/format")
+	plain.expect("* usage: /format plain|timestamped|json")
+	plain.send("/format fancy")
+	plain.expect(`* unknown format "fancy", try one of: plain timestamped json`)
+	js.send("/format plain")
+	js.expect("* format is now plain")
+}
+
+func TestCompression(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Compression = true
+	b := startBoard(cfg)
+	plain := dial(t, b, "alice")
+
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go Serve(b, srv)
+	r := bufio.NewReader(cli)
+	prompt := make([]byte, len("username> "))
+	if _, err := io.ReadFull(r, prompt); err != nil || string(prompt) != "username> " {
+		t.Fatalf("prompt %q, %v", prompt, err)
+	}
+	if _, err := cli.Write([]byte{compressHello}); err != nil {
+		t.Fatal(err)
+	}
+	if ack, err := r.ReadByte(); err != nil || ack != compressHello {
+		t.Fatalf("ack %#x, %v", ack, err)
+	}
+	fw, _ := flate.NewWriter(cli, flate.BestSpeed)
+	writeLine := func(line string) {
+		t.Helper()
+		if _, err := fw.Write([]byte(line + "\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fr := bufio.NewReader(flate.NewReader(r))
+	readLine := func(want string) {
+		t.Helper()
+		line, err := fr.ReadString('\n')
+		if err != nil || line != want+"\n" {
+			t.Fatalf("got %q, %v, want %q", line, err, want)
+		}
+	}
+	writeLine("bob")
+	writeLine("/topic")
+	readLine("* no topic is set")
+
+	writeLine("hi alice")
+	plain.expect("bob: hi alice")
+	plain.send("hi bob")
+	readLine("alice: hi bob")
+}
+
+func TestCapabilities(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := connect(t, b)
+	alice.expect("username> ")
+	alice.send("CAPS color typing")
+	alice.expect("username> ")
+	alice.send("alice")
+	alice.sync()
+	bob := dial(t, b, "bob")
+
+	bob.send("/typing")
+	alice.expect("* bob is typing")
+	alice.send("/typing")
+	bob.quiet()
+	// Everything else still reaches bob.
+	alice.send("hi")
+	bob.expect("alice: hi")
+}
+
+func TestCRLF(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		crlf bool
+		caps string
+		want string
+	}{
+		{"default", false, "", "\n"},
+		{"config", true, "", "\r\n"},
+		{"caps", false, "CAPS crlf", "\r\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.CRLF = tc.crlf
+			b := startBoard(cfg)
+			srv, cli := net.Pipe()
+			defer cli.Close()
+			go Serve(b, srv)
+			r := bufio.NewReader(cli)
+			prompt := func() {
+				t.Helper()
+				p := make([]byte, len("username> "))
+				if _, err := io.ReadFull(r, p); err != nil || string(p) != "username> " {
+					t.Fatalf("read %q, %v", p, err)
+				}
+			}
+			send := func(line string) {
+				t.Helper()
+				if _, err := cli.Write([]byte(line + "\n")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			prompt()
+			if tc.caps != "" {
+				send(tc.caps)
+				prompt()
+			}
+			send("alice")
+			send("/topic")
+			if line, err := r.ReadString('\n'); err != nil || line != "* no topic is set"+tc.want {
+				t.Fatalf("got %q, %v", line, err)
+			}
+		})
+	}
+}
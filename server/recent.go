@@ -0,0 +1,50 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "time"
+
+// Membership is a login or logout, as kept in a board's log of recent
+// comings and goings.
+type Membership struct {
+	Time   time.Time
+	Name   string
+	Joined bool
+}
+
+// logMembership records that name joined or left, dropping the oldest entry
+// once there are more than RecentSize. Runs on the board goroutine.
+func (b *Board) logMembership(name string, joined bool) {
+	if b.cfg.RecentSize <= 0 {
+		return
+	}
+	b.recent = append(b.recent, Membership{
+		Time:   b.cfg.clock().Now(),
+		Name:   name,
+		Joined: joined,
+	})
+	if over := len(b.recent) - b.cfg.RecentSize; over > 0 {
+		b.recent = b.recent[over:]
+	}
+}
+
+// Recent returns the latest logins and logouts, oldest first.
+func (b *Board) Recent() []Membership {
+	var recent []Membership
+	b.query(func() {
+		recent = append(recent, b.recent...)
+	})
+	return recent
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrNoSuchMessage is returned for a message number the board never handed
+// out.
+var ErrNoSuchMessage = errors.New("no such message")
+
+// Redact takes back the message numbered seq: it is dropped from the history,
+// so that later joiners do not see it, and everyone here is told to hide it.
+// Only the room admin may redact.
+func (b *Board) Redact(by string, seq uint64) error {
+	var err error
+	b.query(func() {
+		if by != b.admin {
+			err = ErrNotAdmin
+			return
+		}
+		if seq == 0 || seq > b.seq {
+			err = ErrNoSuchMessage
+			return
+		}
+		fmt.Printf("[%s] redacts #%d\n", by, seq)
+		b.forgetMessage(seq)
+		b.unpin(seq)
+		for name, c := range b.clients {
+			b.deliver(name, c, &Notification{Type: REDACTED, Seq: seq, Priority: PriorityHigh})
+		}
+	})
+	return err
+}
+
+// forgetMessage removes the message numbered seq from the history, if it is
+// still there.
+func (b *Board) forgetMessage(seq uint64) {
+	b.evict()
+	i := sort.Search(len(b.history), func(i int) bool { return b.history[i].Seq >= seq })
+	if i == len(b.history) || b.history[i].Seq != seq {
+		return
+	}
+	b.history = append(b.history[:i:i], b.history[i+1:]...)
+	if b.budget != nil {
+		b.budget.drop(b, seq)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrTooManyRooms is returned when creating a room would take the server past
+// MaxRooms.
+var ErrTooManyRooms = errors.New("too many rooms")
+
+// ErrRoomExists is returned by Create for a room that is already there.
+var ErrRoomExists = errors.New("room already exists")
+
+// BoardRegistry owns the set of boards on a server, creating each one with
+// its room's configuration the first time it is asked for.
+type BoardRegistry struct {
+	cfg    Config
+	mu     sync.Mutex
+	boards map[string]*Board
+	closed bool
+	budget *historyBudget
+	// sched sends the configured Announcements, if there are any.
+	sched *Scheduler
+	// created holds the rooms made with Create, which with ExplicitRooms
+	// can be joined even once they have been reaped.
+	created map[string]bool
+}
+
+func NewBoardRegistry(cfg Config) *BoardRegistry {
+	r := &BoardRegistry{
+		cfg:     cfg,
+		boards:  make(map[string]*Board),
+		created: make(map[string]bool),
+	}
+	if cfg.HistoryBudget > 0 {
+		r.budget = newHistoryBudget(cfg.HistoryBudget)
+	}
+	if len(cfg.Announcements) > 0 {
+		r.sched = NewScheduler(cfg.clock(), r.Announce)
+		for _, a := range cfg.Announcements {
+			r.sched.Schedule(a)
+		}
+	}
+	return r
+}
+
+// GetOrCreate returns the board called name, creating it and starting its
+// goroutine if it does not exist yet. With ReapAfter set a board may be
+// reaped once it is empty, after which logins to it fail with
+// ErrBoardClosed; ask again for a fresh one. Once the registry is closed, or
+// when creating the board would take it past MaxRooms, GetOrCreate returns
+// nil.
+func (r *BoardRegistry) GetOrCreate(name string) *Board {
+	b, _ := r.getOrCreate(name)
+	return b
+}
+
+// Create makes the room called name, so that it can be joined under
+// ExplicitRooms.
+func (r *BoardRegistry) Create(name string) error {
+	r.mu.Lock()
+	_, exists := r.boards[name]
+	if exists || r.created[name] {
+		r.mu.Unlock()
+		return ErrRoomExists
+	}
+	r.created[name] = true
+	r.mu.Unlock()
+	if _, err := r.getOrCreate(name); err != nil {
+		r.mu.Lock()
+		delete(r.created, name)
+		r.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// open returns the room called name for a client to join. With ExplicitRooms
+// that is only a room that exists, was made with Create or is configured in
+// Rooms; joining any other fails with ErrNoSuchRoom.
+func (r *BoardRegistry) open(name string) (*Board, error) {
+	if r.cfg.ExplicitRooms {
+		_, configured := r.cfg.Rooms[name]
+		r.mu.Lock()
+		_, exists := r.boards[name]
+		known := exists || configured || r.created[name]
+		r.mu.Unlock()
+		if !known {
+			return nil, ErrNoSuchRoom
+		}
+	}
+	return r.getOrCreate(name)
+}
+
+// getOrCreate is GetOrCreate, saying why it returned no board. The lock is
+// held until a new board is registered and its goroutine started, so callers
+// racing for the same new room all get the one board.
+func (r *BoardRegistry) getOrCreate(name string) (*Board, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, ErrBoardClosed
+	}
+	b, ok := r.boards[name]
+	if !ok {
+		if r.cfg.MaxRooms > 0 && len(r.boards) >= r.cfg.MaxRooms {
+			return nil, ErrTooManyRooms
+		}
+		b = NewBoardWithConfig(name, r.cfg)
+		if name != r.cfg.defaultRoom() {
+			// New connections are served by the default room's
+			// board, so it has to stay.
+			b.onReap = r.reap
+		}
+		b.rooms = r
+		b.budget = r.budget
+		r.boards[name] = b
+		go b.HandleBoard()
+	}
+	return b, nil
+}
+
+// reap forgets b, which is idle, reporting whether it was still registered.
+// Runs on b's goroutine.
+func (r *BoardRegistry) reap(b *Board) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.boards[b.Name] != b {
+		return false
+	}
+	delete(r.boards, b.Name)
+	return true
+}
+
+// Announce sends msg as a system notice to everyone in every room.
+func (r *BoardRegistry) Announce(msg string) {
+	r.mu.Lock()
+	boards := make([]*Board, 0, len(r.boards))
+	for _, b := range r.boards {
+		boards = append(boards, b)
+	}
+	r.mu.Unlock()
+	for _, b := range boards {
+		b.Announce(msg)
+	}
+}
+
+// Close closes every board and waits for their goroutines to exit, which
+// also cancels any pending reap and scheduled announcements.
+func (r *BoardRegistry) Close() {
+	if r.sched != nil {
+		r.sched.Stop()
+	}
+	r.mu.Lock()
+	boards := r.boards
+	r.boards = make(map[string]*Board)
+	r.closed = true
+	r.mu.Unlock()
+	for _, b := range boards {
+		b.Close()
+	}
+}
+
+// CloseRoom closes the board called name. With a FallbackRoom, its clients
+// are moved there as if by Merge rather than being left in a closed room;
+// the fallback is created if need be, and cannot itself be closed this way
+// without losing its clients.
+func (r *BoardRegistry) CloseRoom(name string) error {
+	if fallback := r.cfg.FallbackRoom; fallback != "" && fallback != name {
+		why := fmt.Sprintf("room %s was closed, you have been moved to %s", name, fallback)
+		if _, err := r.getOrCreate(fallback); err == nil {
+			if err := r.move(name, fallback, why); err != ErrBoardClosed {
+				return err
+			}
+		}
+		fmt.Printf("cannot move clients of [%s] to [%s]\n", name, fallback)
+	}
+	r.mu.Lock()
+	b := r.boards[name]
+	delete(r.boards, name)
+	delete(r.created, name)
+	r.mu.Unlock()
+	if b == nil {
+		return ErrNoSuchRoom
+	}
+	b.Close()
+	return nil
+}
+
+// Get returns the board called name, or nil if there is none.
+func (r *BoardRegistry) Get(name string) *Board {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.boards[name]
+}
+
+// Names returns the names of all boards in sorted order.
+func (r *BoardRegistry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.boards))
+	for name := range r.boards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RoomsOf returns the names of the boards that name is logged in to, in
+// sorted order.
+func (r *BoardRegistry) RoomsOf(name string) []string {
+	var rooms []string
+	for _, room := range r.Names() {
+		if b := r.Get(room); b != nil && b.has(name) {
+			rooms = append(rooms, room)
+		}
+	}
+	return rooms
+}
+
+// join moves the session's client to the room called room, keeping its name,
+// and returns what to tell it. The client stays where it is if it cannot
+// get in. Only the reader may call join.
+func (s *seat) join(room string, reply chan *Notification) string {
+	cur, name := s.settle()
+	if cur.rooms == nil {
+		return "this server has only the one room"
+	}
+	if room == "" {
+		return "usage: /join <room>"
+	}
+	b, err := cur.rooms.open(room)
+	if err != nil {
+		return fmt.Sprintf("cannot join %s: %s", room, err)
+	}
+	if b == cur {
+		return "you are already in " + room
+	}
+	if _, err := b.login(name, s.from, reply, nil); err != nil {
+		return fmt.Sprintf("cannot join %s: %s", room, err)
+	}
+	cur.Logout(name)
+	s.mu.Lock()
+	s.b, s.last = b, b
+	s.mu.Unlock()
+	return "you are now in " + room
+}
@@ -0,0 +1,446 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReapIdleBoard(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.ReapAfter = time.Minute
+	boards := NewBoardRegistry(cfg)
+	b := boards.GetOrCreate("lobby")
+	b.Login("alice", make(chan *Notification, 10))
+	// Nothing is reaped while someone is there.
+	clock.Advance(time.Hour)
+	b.sync()
+	b.Logout("alice")
+	b.sync()
+
+	clock.Advance(time.Minute)
+	<-b.done
+	if names := boards.Names(); len(names) != 0 {
+		t.Errorf("boards left: %v", names)
+	}
+	if err := b.Login("bob", make(chan *Notification, 10)); err != ErrBoardClosed {
+		t.Errorf("login to a reaped board got %v", err)
+	}
+	if fresh := boards.GetOrCreate("lobby"); fresh == b {
+		t.Error("got the reaped board back")
+	}
+}
+
+func TestRegistryCloseWithPendingReap(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.ReapAfter = time.Minute
+	boards := NewBoardRegistry(cfg)
+	idle := boards.GetOrCreate("idle")
+	busy := boards.GetOrCreate("busy")
+	busy.Login("alice", make(chan *Notification, 10))
+	idle.sync()
+
+	boards.Close()
+	// The reap timer was stopped, so this must not touch the boards.
+	clock.Advance(time.Minute)
+	idle.Close()
+	busy.Close()
+	if boards.GetOrCreate("idle") != nil {
+		t.Error("closed registry created a board")
+	}
+	if err := busy.Login("bob", make(chan *Notification, 10)); err != ErrBoardClosed {
+		t.Errorf("login after Close got %v", err)
+	}
+	busy.Logout("alice")
+	busy.Publish("alice", "ignored")
+}
+
+func TestMerge(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Clock = newFakeClock()
+	boards := NewBoardRegistry(cfg)
+	a := boards.GetOrCreate("a")
+	b := boards.GetOrCreate("b")
+	alice := dial(t, a, "alice")
+	bobA := dial(t, a, "bob")
+	bobB := dial(t, b, "bob")
+	carol := dial(t, b, "carol")
+	// dave is in-process and never follows the move, so a passes his
+	// messages on for him.
+	dave := make(chan *Notification, 10)
+	a.Login("dave", dave)
+
+	if err := boards.Merge("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	alice.expect("* room a was merged into b", "* bob-2, dave joined from a")
+	bobA.expect("* room a was merged into b, you are now bob-2", "* alice, dave joined from a")
+	bobB.expect("* alice, bob-2, dave joined from a")
+	carol.expect("* alice, bob-2, dave joined from a")
+	if n := recv(t, dave); n.Type != MOVED || n.Name != "dave" {
+		t.Errorf("dave got %+v", n)
+	}
+	recv(t, dave)
+	if names := boards.Names(); len(names) != 1 || names[0] != "b" {
+		t.Errorf("boards after merge: %v", names)
+	}
+
+	bobA.send("hi")
+	bobA.quiet()
+	a.Publish("dave", "hey")
+	for _, c := range []*testClient{alice, bobB, carol} {
+		c.expect("bob-2: hi", "dave: hey")
+	}
+	alice.quiet()
+	a.Logout("dave")
+	<-a.done
+	if err := a.Login("erin", make(chan *Notification, 10)); err != ErrBoardClosed {
+		t.Errorf("login to a merged board got %v", err)
+	}
+	bobB.send("/seen bob-2")
+	bobB.expect("* bob-2 is online, last said something 0s ago")
+}
+
+func TestMergeErrors(t *testing.T) {
+	boards := NewBoardRegistry(DefaultConfig())
+	boards.GetOrCreate("a")
+	if err := boards.Merge("a", "a"); err == nil {
+		t.Error("merged a room into itself")
+	}
+	if err := boards.Merge("a", "nowhere"); err != ErrNoSuchRoom {
+		t.Errorf("merged into a missing room, got %v", err)
+	}
+	if names := boards.Names(); len(names) != 1 {
+		t.Errorf("boards: %v", names)
+	}
+}
+
+func TestMaxRooms(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxRooms = 2
+	boards := NewBoardRegistry(cfg)
+	a := boards.GetOrCreate("a")
+	if boards.GetOrCreate("b") == nil {
+		t.Fatal("refused a room under the cap")
+	}
+	if boards.GetOrCreate("c") != nil {
+		t.Error("created a room past the cap")
+	}
+	if boards.GetOrCreate("a") != a {
+		t.Error("lost an existing room at the cap")
+	}
+
+	alice := dial(t, a, "alice")
+	alice.send("/join c")
+	alice.expect("* cannot join c: too many rooms")
+	alice.send("/join b")
+	alice.expect("* you are now in b")
+	bob := dial(t, boards.Get("b"), "bob")
+	bob.send("hi")
+	alice.expect("bob: hi")
+	alice.send("/join b")
+	alice.expect("* you are already in b")
+	a.sync()
+	if s := a.Stats(); s.Count != 0 {
+		t.Errorf("a still has %v", s.Members)
+	}
+}
+
+func TestJoinRoomOptions(t *testing.T) {
+	yes := true
+	cfg := DefaultConfig()
+	cfg.Rooms = map[string]RoomConfig{
+		"dev": {ShowSeq: &yes, EscapeMarkdown: &yes},
+	}
+	boards := NewBoardRegistry(cfg)
+	lobby := boards.GetOrCreate("lobby")
+	alice := dial(t, lobby, "alice")
+	lobby.Publish("bob", "*hi*")
+	alice.expect("bob: *hi*")
+
+	// The session carries on from the lobby, but is shown dev its way.
+	alice.send("/join dev")
+	alice.expect("* you are now in dev")
+	boards.Get("dev").Publish("carol", "*hi*")
+	alice.expect(`#1 carol: \*hi\*`)
+
+	// And the lobby its own way again on the way back.
+	alice.send("/join lobby")
+	alice.expect("* you are now in lobby")
+	lobby.Publish("bob", "*bye*")
+	alice.expect("bob: *bye*")
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	boards := NewBoardRegistry(DefaultConfig())
+	defer boards.Close()
+	const n = 50
+	got := make(chan *Board, n)
+	var start sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < n; i++ {
+		go func() {
+			start.Wait()
+			got <- boards.GetOrCreate("first")
+		}()
+	}
+	start.Done()
+	b := <-got
+	for i := 1; i < n; i++ {
+		if other := <-got; other != b {
+			t.Fatalf("got two boards for one room, %p and %p", b, other)
+		}
+	}
+	if names := boards.Names(); len(names) != 1 {
+		t.Errorf("boards: %v", names)
+	}
+
+	// Clients joining a new room all at once end up together.
+	var clients []*testClient
+	for i := 0; i < 10; i++ {
+		from := boards.GetOrCreate(fmt.Sprintf("from%d", i))
+		clients = append(clients, dial(t, from, fmt.Sprintf("user%d", i)))
+	}
+	for _, c := range clients {
+		c.send("/join new")
+	}
+	for _, c := range clients {
+		c.expect("* you are now in new")
+	}
+	joined := boards.Get("new")
+	if s := joined.Stats(); s.Count != len(clients) {
+		t.Errorf("new has %v", s.Members)
+	}
+}
+
+func TestJoinSingleRoom(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	alice.send("/join other")
+	alice.expect("* this server has only the one room")
+}
+
+func TestCloseRoomFallback(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FallbackRoom = "lobby"
+	boards := NewBoardRegistry(cfg)
+	games := boards.GetOrCreate("games")
+	alice := dial(t, games, "alice")
+	bob := dial(t, games, "bob")
+
+	if err := boards.CloseRoom("games"); err != nil {
+		t.Fatal(err)
+	}
+	alice.expect("* room games was closed, you have been moved to lobby", "* bob joined from games")
+	bob.expect("* room games was closed, you have been moved to lobby", "* alice joined from games")
+	alice.send("still here")
+	bob.expect("alice: still here")
+	lobby := boards.Get("lobby")
+	if s := lobby.Stats(); s.Count != 2 {
+		t.Errorf("lobby has %v", s.Members)
+	}
+	if names := boards.Names(); len(names) != 1 || names[0] != "lobby" {
+		t.Errorf("boards: %v", names)
+	}
+
+	// Without somewhere to go, the room just closes.
+	if err := boards.CloseRoom("lobby"); err != nil {
+		t.Fatal(err)
+	}
+	<-lobby.done
+	alice.expect("* room is closed")
+	alice.closed()
+	bob.expect("* room is closed")
+	bob.closed()
+	if err := boards.CloseRoom("lobby"); err != ErrNoSuchRoom {
+		t.Errorf("closing a missing room got %v", err)
+	}
+}
+
+func TestMyRooms(t *testing.T) {
+	boards := NewBoardRegistry(DefaultConfig())
+	defer boards.Close()
+	alice := dial(t, boards.GetOrCreate("lobby"), "alice")
+	alice.send("/myrooms")
+	alice.expect("* your rooms: lobby")
+
+	// The same name on a second connection counts too.
+	again := dial(t, boards.GetOrCreate("games"), "alice")
+	alice.send("/myrooms")
+	alice.expect("* your rooms: games, lobby")
+	again.send("/join chess")
+	again.expect("* you are now in chess")
+	alice.send("/myrooms")
+	alice.expect("* your rooms: chess, lobby")
+	again.send("/quit")
+	again.expect("* goodbye")
+	alice.send("/myrooms")
+	alice.expect("* your rooms: lobby")
+
+	b := startBoard(DefaultConfig())
+	bob := dial(t, b, "bob")
+	bob.send("/myrooms")
+	bob.expect("* your rooms: test")
+}
+
+func TestBroadcast(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Operators = []string{"alice"}
+	boards := NewBoardRegistry(cfg)
+	defer boards.Close()
+	alice := dial(t, boards.GetOrCreate("lobby"), "alice")
+	bob := dial(t, boards.GetOrCreate("lobby"), "bob")
+	carol := dial(t, boards.GetOrCreate("games"), "carol")
+	dave := dial(t, boards.GetOrCreate("chess"), "dave")
+
+	bob.send("/broadcast hello")
+	bob.expect("* " + ErrNotOperator.Error())
+	// dave is the admin of chess, for being first there, but that is no
+	// say over the other rooms.
+	dave.send("/broadcast pwned")
+	dave.expect("* " + ErrNotOperator.Error())
+	alice.send("/broadcast")
+	alice.expect("* usage: /broadcast <text>")
+
+	alice.send("/broadcast back in five")
+	for _, c := range []*testClient{alice, bob, carol, dave} {
+		c.expect("* alice to all rooms: back in five")
+	}
+	for _, c := range []*testClient{alice, bob, carol, dave} {
+		c.quiet()
+	}
+}
+
+func TestExplicitRooms(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ExplicitRooms = true
+	cfg.Rooms = map[string]RoomConfig{"games": {}}
+	cfg.Operators = []string{"alice"}
+	boards := NewBoardRegistry(cfg)
+	defer boards.Close()
+	lobby := boards.GetOrCreate("lobby")
+	alice := dial(t, lobby, "alice")
+	bob := dial(t, lobby, "bob")
+
+	bob.send("/join chesss")
+	bob.expect("* cannot join chesss: no such room")
+	bob.send("/create chess")
+	bob.expect("* " + ErrNotOperator.Error())
+	alice.send("/create chess")
+	alice.expect("* created chess, /join chess to go there")
+	alice.send("/create chess")
+	alice.expect("* cannot create chess: room already exists")
+	bob.send("/join chess")
+	bob.expect("* you are now in chess")
+	// Configured rooms need no creating.
+	bob.send("/join games")
+	bob.expect("* you are now in games")
+	if names := boards.Names(); fmt.Sprint(names) != "[chess games lobby]" {
+		t.Errorf("rooms: %v", names)
+	}
+}
+
+func TestDefaultRoom(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DefaultRoom = "lobby"
+	l := &scriptedListener{next: make(chan interface{})}
+	go serveRooms(l, cfg)
+	login := func(name string) *testClient {
+		srv, cli := net.Pipe()
+		t.Cleanup(func() { cli.Close() })
+		l.next <- srv
+		c := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+		go c.read()
+		c.expect("username> ")
+		c.send(name)
+		c.unread = c.sync()
+		return c
+	}
+
+	// Neither of them asks to join anywhere.
+	alice := login("alice")
+	bob := login("bob")
+	bob.send("hi")
+	alice.expect("bob: hi")
+	alice.send("/myrooms")
+	alice.expect("* your rooms: lobby")
+}
+
+func TestRoomMessageTemplate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Clock = newFakeClock()
+	cfg.HistorySize = 10
+	tmpl := `[{{.Time.Format "15:04"}}] <{{.Name}}> {{.Msg}}`
+	cfg.Rooms = map[string]RoomConfig{"fancy": {MessageTemplate: &tmpl}}
+	boards := NewBoardRegistry(cfg)
+	defer boards.Close()
+
+	fancy := boards.GetOrCreate("fancy")
+	alice := dial(t, fancy, "alice")
+	fancy.Publish("bob", "hello")
+	alice.expect("[00:00] <bob> hello")
+	// History is shown the same way, and notices are left alone.
+	carol := dial(t, fancy, "carol")
+	carol.expect("[00:00] <bob> hello")
+	carol.send("/topic")
+	carol.expect("* no topic is set")
+
+	plain := boards.GetOrCreate("plain")
+	dave := dial(t, plain, "dave")
+	plain.Publish("bob", "hello")
+	dave.expect("bob: hello")
+}
+
+func TestSessions(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	boards := NewBoardRegistry(cfg)
+	defer boards.Close()
+	if s := boards.Sessions(); len(s) != 0 {
+		t.Errorf("sessions before anyone came: %v", s)
+	}
+	lobby := boards.GetOrCreate("lobby")
+	dial(t, lobby, "bob")
+	dial(t, lobby, "alice")
+	dial(t, boards.GetOrCreate("games"), "alice")
+	boards.GetOrCreate("games").Login("bot", make(chan *Notification, 10))
+
+	var got []string
+	for _, s := range boards.Sessions() {
+		got = append(got, s.Room+"/"+s.Name+" "+s.Addr)
+		if s.Addr != "" && !s.Connected.Equal(clock.Now()) {
+			t.Errorf("%s/%s connected at %s", s.Room, s.Name, s.Connected)
+		}
+	}
+	want := []string{
+		"games/alice pipe",
+		"games/bot ",
+		"lobby/alice pipe",
+		"lobby/bob pipe",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sessions:\n%q\nwant\n%q", got, want)
+	}
+}
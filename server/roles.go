@@ -0,0 +1,93 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotOperator is returned for actions that reach beyond a single room,
+// which only the server's Operators may take.
+var ErrNotOperator = errors.New("only a server operator can do that")
+
+// isOperator reports whether name is one of the configured Operators.
+func (c *Config) isOperator(name string) bool {
+	for _, op := range c.Operators {
+		if op == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Role ranks a client for delivery. When the board fans a message out,
+// admins are served first and spectators last, and a spectator that is not
+// keeping up has messages dropped rather than holding up the rest of the
+// room.
+type Role int
+
+const (
+	RoleRegular Role = iota
+	RoleSpectator
+	// RoleAdmin is only ever held by the room admin, and comes with /grant
+	// rather than SetRole.
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleRegular:
+		return "regular"
+	case RoleSpectator:
+		return "spectator"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// deliveryOrder is the order broadcast serves the roles in.
+var deliveryOrder = []Role{RoleAdmin, RoleRegular, RoleSpectator}
+
+// roleOf returns the role of the client c logged in as name.
+func (b *Board) roleOf(name string, c *client) Role {
+	if name == b.admin {
+		return RoleAdmin
+	}
+	return c.role
+}
+
+// SetRole makes name a regular member or a spectator. Only the room admin
+// may change roles.
+func (b *Board) SetRole(by, name string, role Role) error {
+	if role != RoleRegular && role != RoleSpectator {
+		return fmt.Errorf("cannot make anyone %s, try regular or spectator", role)
+	}
+	var err error
+	b.query(func() {
+		c := b.clients[name]
+		switch {
+		case b.admin != by:
+			err = ErrNotAdmin
+		case c == nil:
+			err = ErrNoSuchUser
+		default:
+			fmt.Printf("[%s] is now a %s\n", name, role)
+			c.role = role
+		}
+	})
+	return err
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Announcement is a notice for a Scheduler to send. It goes out at At, or
+// right away if At is zero or has passed, and then again every Every if that
+// is set.
+type Announcement struct {
+	At    time.Time
+	Every time.Duration
+	Msg   string
+}
+
+// Scheduler sends announcements when they are due, each from a goroutine of
+// its own, until it is stopped.
+type Scheduler struct {
+	clock Clock
+	send  func(msg string)
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	stop  chan struct{}
+	done  bool
+}
+
+// NewScheduler returns a Scheduler that hands announcements to send, timed
+// by clock.
+func NewScheduler(clock Clock, send func(msg string)) *Scheduler {
+	return &Scheduler{clock: clock, send: send, stop: make(chan struct{})}
+}
+
+// Schedule arranges for a to be sent. The returned function cancels it.
+// Once the scheduler is stopped Schedule does nothing.
+func (s *Scheduler) Schedule(a Announcement) (cancel func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return func() {}
+	}
+	cancelled := make(chan struct{})
+	var once sync.Once
+	s.wg.Add(1)
+	go s.run(a, cancelled)
+	return func() { once.Do(func() { close(cancelled) }) }
+}
+
+// Stop cancels every announcement and waits for their goroutines to exit.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	if !s.done {
+		s.done = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Scheduler) run(a Announcement, cancelled <-chan struct{}) {
+	defer s.wg.Done()
+	next := a.At
+	for {
+		t := s.clock.NewTimer(next.Sub(s.clock.Now()))
+		select {
+		case <-t.C():
+		case <-cancelled:
+			t.Stop()
+			return
+		case <-s.stop:
+			t.Stop()
+			return
+		}
+		s.send(a.Msg)
+		if a.Every <= 0 {
+			return
+		}
+		if next.IsZero() {
+			next = s.clock.Now()
+		}
+		next = next.Add(a.Every)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledAnnouncements(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration, 10)
+	start := clock.Now()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.Announcements = []Announcement{
+		{At: start.Add(10 * time.Minute), Msg: "maintenance in 10 minutes"},
+		{At: start.Add(15 * time.Minute), Msg: "maintenance in 5 minutes"},
+		{At: start.Add(time.Hour), Every: time.Hour, Msg: "on the hour"},
+	}
+	r := NewBoardRegistry(cfg)
+	defer r.Close()
+	alice := make(chan *Notification, 10)
+	r.GetOrCreate("1").Login("alice", alice)
+	bob := make(chan *Notification, 10)
+	r.GetOrCreate("2").Login("bob", bob)
+	for range cfg.Announcements {
+		<-clock.started
+	}
+
+	expect := func(want string) {
+		t.Helper()
+		for _, ch := range []chan *Notification{alice, bob} {
+			if n := recv(t, ch); n.Msg != want {
+				t.Errorf("got %q, want %q", n.Msg, want)
+			}
+		}
+	}
+	clock.Advance(10 * time.Minute)
+	expect("maintenance in 10 minutes")
+	clock.Advance(5 * time.Minute)
+	expect("maintenance in 5 minutes")
+	clock.Advance(45 * time.Minute)
+	expect("on the hour")
+	// The repeat is timed from when it was due, not from when it went out.
+	<-clock.started
+	clock.Advance(time.Hour)
+	expect("on the hour")
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration, 10)
+	sent := make(chan string, 10)
+	s := NewScheduler(clock, func(msg string) { sent <- msg })
+	cancel := s.Schedule(Announcement{At: clock.Now().Add(time.Minute), Msg: "cancelled"})
+	s.Schedule(Announcement{At: clock.Now().Add(time.Minute), Msg: "stopped"})
+	<-clock.started
+	<-clock.started
+	cancel()
+	s.Stop()
+	clock.Advance(time.Minute)
+	select {
+	case msg := <-sent:
+		t.Errorf("sent %q after being cancelled", msg)
+	default:
+	}
+	// Stopped schedulers take nothing new.
+	s.Schedule(Announcement{Msg: "late"})
+	s.Stop()
+	if len(sent) > 0 {
+		t.Errorf("sent %q after stopping", <-sent)
+	}
+}
@@ -16,9 +16,18 @@ package server
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+	"unicode/utf8"
 )
 
 type MsgType int
@@ -27,114 +36,1624 @@ const (
 	LOGIN MsgType = iota
 	LOGOUT
 	TEXTLINE
+	ACK
+	NOTICE
+	QUERY
+	// DIRECT is a message from Name to a single client.
+	DIRECT
+	// MOVED tells a client that its room was merged into another. Name is
+	// its name there.
+	MOVED
+	// REDACTED tells clients that the admin took back the message numbered
+	// Seq.
+	REDACTED
+	// TYPING tells clients that Name is typing.
+	TYPING
+	// PING asks the board goroutine to send itself back on ReplyCh, to show
+	// that it is still handling messages.
+	PING
+)
+
+// Priority orders the notifications queued for a client.
+type Priority int
+
+const (
+	PriorityNormal Priority = iota
+	// PriorityHigh is for system messages such as moderation and room
+	// changes. They are never dropped for a full queue, and with
+	// DeliveryWorkers they go ahead of any normal ones still waiting.
+	PriorityHigh
 )
 
 type Notification struct {
 	Type    MsgType
 	Msg     string
 	Name    string
+	Seq     uint64
 	ReplyCh chan<- *Notification
+	// AckCh, if set on a TEXTLINE, receives an ACK carrying the Seq the
+	// board assigned to the message.
+	AckCh chan<- *Notification
+	// Part and Parts number the fragments of a message that was split for
+	// being too long. Parts is zero for an unsplit message.
+	Part  int
+	Parts int
+	// Time is when the board accepted a TEXTLINE.
+	Time     time.Time
+	Priority Priority
+	// Parent, if set on a TEXTLINE, is the Seq of the message it replies
+	// to.
+	Parent uint64
+	// Mention is set on the copies of a TEXTLINE sent to the users it
+	// mentions by "@name".
+	Mention bool
+	// TTL, if set on a TEXTLINE, makes it ephemeral: it is never kept in
+	// the history, and clients that can are asked to hide it after this
+	// long.
+	TTL time.Duration
+	// Nick, if set on a TEXTLINE or DIRECT, is the nickname of the sender,
+	// shown in place of Name.
+	Nick string
+
+	// errCh carries the outcome of a LOGIN back to the caller.
+	errCh chan<- error
+	// posCh, if set, is told a LOGIN's place in line while it waits for
+	// room. The board both sends and receives on it.
+	posCh chan int
+	// fn is run on the board goroutine for a QUERY.
+	fn func()
+	// board is where a MOVED client now is.
+	board *Board
+	// receipt, if set on a DIRECT, is closed once the message has been
+	// written to the recipient's connection.
+	receipt chan struct{}
+	// left, if set on a LOGOUT, is closed once the board will send nothing
+	// more to the client.
+	left chan struct{}
+	// own is set on a session's copy of a TEXTLINE that its client sent.
+	own bool
+	// from, if set on a LOGIN, is the connection the client is on.
+	from *origin
+	// last marks the NOTICE a board sends everyone as it shuts down.
+	// Nothing follows it.
+	last bool
+	// line has a NOTICE written as a bare line of server text, like those
+	// of refuseRetry, rather than rendered.
+	line bool
+	// tmpl, if set on a TEXTLINE, is the MessageTemplate of the board it
+	// was published on.
+	tmpl *template.Template
 }
 
+// ErrNameTaken is returned by Login when another client on the board already
+// uses the requested name.
+var ErrNameTaken = errors.New("name is already in use")
+
+// ErrNotAdmin is returned when a non-admin attempts an admin-only operation.
+var ErrNotAdmin = errors.New("only the room admin can do that")
+
+// ErrNoSuchUser is returned when an operation names a user not on the board.
+var ErrNoSuchUser = errors.New("no such user")
+
+// ErrRateLimited is returned when a user repeats a limited action too soon.
+var ErrRateLimited = errors.New("you are doing that too often")
+
+// ErrNoBanList is returned by Ban and Unban when the server has no ban list.
+var ErrNoBanList = errors.New("bans are not enabled on this server")
+
+// ErrBoardClosed is returned by Login once the board has been closed.
+var ErrBoardClosed = errors.New("room is closed")
+
+// ErrBoardNotStarted is returned when nothing is running HandleBoard for a
+// board that has not been closed either.
+var ErrBoardNotStarted = errors.New("room is not running")
+
+// ErrRoomFull is returned by Login when the board already has MaxClients
+// clients.
+var ErrRoomFull = errors.New("room is full")
+
+// ErrNotDelivered is returned by Direct when the recipient's send queue is
+// full.
+var ErrNotDelivered = errors.New("message not delivered")
+
+// ErrNameRequired is returned for an empty name when anonymous logins are not
+// allowed.
+var ErrNameRequired = errors.New("a name is required")
+
+// ErrNameTooLong is returned by Login for a name longer than MaxNameLength.
+var ErrNameTooLong = errors.New("name is too long")
+
 // Board is an object to handle a single string of messages for a set of
-// clients. A Board supports login, logout, and publish operations. No history
-// is kept.
+// clients. A Board supports login, logout, and publish operations. The last
+// HistorySize messages are kept and replayed to clients as they join.
 type Board struct {
 	Name     string
 	wakeupCh chan *Notification
-	clients  map[string]chan<- *Notification
+	clients  map[string]*client
+	countFn  func(n int)
+	cfg      Config
+	seq      uint64
+	topic    string
+	// slowMode is the least time allowed between two messages from one
+	// user. It starts out as BoardConfig.SlowMode.
+	slowMode time.Duration
+	history  []Message
+	guests   int
+	joins    uint64
+	admin    string
+	banned   *regexp.Regexp
+	// tmpl is the parsed MessageTemplate, if any.
+	tmpl *template.Template
+	// locked turns away new logins, with /lock.
+	locked bool
+	// pinned holds the messages pinned with /pin, in order, whether or not
+	// they are still in the history.
+	pinned []Message
+	// lastPresence holds when each user last logged in or out, and
+	// lastMessage when they last spoke. Both outlive the client entry so
+	// that offline users can be looked up.
+	lastPresence map[string]time.Time
+	lastMessage  map[string]time.Time
+	// lastReport rate-limits /report per reporter.
+	lastReport map[string]time.Time
+	// watchers maps a user to the set of clients that asked to hear when
+	// they come and go.
+	watchers map[string]map[string]bool
+	// waiting holds the logins queued for a full room, oldest first.
+	waiting []*Notification
+	// Join and leave notices waiting out the CoalesceWindow.
+	pendingJoins  []string
+	pendingLeaves []string
+	coalesceTimer Timer
+	// started is closed when HandleBoard starts, and done when it has
+	// returned.
+	started chan struct{}
+	done    chan struct{}
+	// closing is set on the board goroutine to make HandleBoard return.
+	closing bool
+	// onReap, if set, is asked whether an idle board may be reaped, and
+	// forgets it if so.
+	onReap    func(*Board) bool
+	reapTimer Timer
+	// mergedInto is set once the board has been merged into another. It
+	// then only passes messages on for the moved clients, keyed in forward
+	// by their old name, until their sessions catch up.
+	mergedInto *Board
+	forward    map[string]string
+	// recent logs the latest logins and logouts for /recent.
+	recent []Membership
+	// gone holds when each leave notice waiting out the LeaveGrace is due.
+	gone       map[string]time.Time
+	graceTimer Timer
+	// throttles holds the users throttled under a ThrottleNoticeWindow,
+	// until they are told they can send again.
+	throttles     map[string]*throttle
+	throttleTimer Timer
+	// throttleAt is when throttleTimer fires.
+	throttleAt time.Time
+	// floods tracks each user's recent messages for flood protection.
+	floods map[string]*flood
+	// federated holds the time of the newest message taken from each peer,
+	// so that none is taken twice.
+	federated map[string]time.Time
+	// budget, if set, is shared by every board in the registry to cap their
+	// history between them. It sets evictTo and pokes evictCh to have the
+	// history trimmed up to that sequence number.
+	budget  *historyBudget
+	evictTo atomic.Uint64
+	evictCh chan struct{}
+	// rooms is the registry that created the board, if any, for /join.
+	rooms *BoardRegistry
+	// stats holds the latest *BoardStats, for reading without going
+	// through the board goroutine.
+	stats atomic.Value
+	// unhealthy is set while the last Probe went unanswered.
+	unhealthy atomic.Bool
 }
 
-func NewBoard(name string) *Board {
-	return &Board{
+// client is the board's view of a logged in user.
+type client struct {
+	ch chan<- *Notification
+	// joined orders clients by login, oldest first.
+	joined uint64
+	// congested is set once the send queue passes the high watermark and
+	// cleared when it drains to the low watermark.
+	congested bool
+	// out, with DeliveryWorkers, queues everything for ch.
+	out *outbox
+	// away, if set, is the user's away message.
+	away string
+	// role is RoleRegular or RoleSpectator; the admin is b.admin.
+	role Role
+	// from is the connection the client is on, or nil for one in-process.
+	from *origin
+	// sent counts the messages the client published here.
+	sent int
+	// shadowMuted keeps the client's messages from everyone else, without
+	// telling it.
+	shadowMuted bool
+	// nick, if set, is shown on the client's messages in place of its name.
+	nick string
+	// hungUp is set once the board has closed the client's connection for
+	// falling behind.
+	hungUp bool
+}
+
+// NewBoard returns a board with the default configuration. If bc is given it
+// replaces the default board settings entirely. NewBoardWithOptions can
+// change anything else.
+func NewBoard(name string, bc ...BoardConfig) *Board {
+	var opts []BoardOption
+	if len(bc) > 0 {
+		opts = append(opts, WithBoardConfig(bc[0]))
+	}
+	return NewBoardWithOptions(name, opts...)
+}
+
+// NewBoardWithConfig returns a board configured by cfg, including any
+// override cfg.Rooms has for name.
+func NewBoardWithConfig(name string, cfg Config) *Board {
+	cfg = cfg.ForRoom(name)
+	b := &Board{
 		Name:     name,
 		wakeupCh: make(chan *Notification),
-		clients:  make(map[string]chan<- *Notification),
+		started:  make(chan struct{}),
+		done:     make(chan struct{}),
+		evictCh:  make(chan struct{}, 1),
+		clients:  make(map[string]*client),
+		cfg:      cfg,
+		slowMode: cfg.SlowMode,
+		banned:   bannedRegexp(cfg.BannedWords, cfg.BannedWordsWholeWord),
+		tmpl:     boardTemplate(name, cfg.BoardConfig),
+
+		lastPresence: make(map[string]time.Time),
+		lastMessage:  make(map[string]time.Time),
+		lastReport:   make(map[string]time.Time),
+		watchers:     make(map[string]map[string]bool),
+		floods:       make(map[string]*flood),
+		federated:    make(map[string]time.Time),
 	}
+	if fn := cfg.OnCountChange; fn != nil {
+		b.countFn = func(n int) { fn(name, n) }
+	}
+	b.publishStats()
+	return b
+}
+
+// bannedRegexp builds a single case-insensitive matcher for words, or nil if
+// there is nothing to match.
+func bannedRegexp(words []string, wholeWord bool) *regexp.Regexp {
+	var alts []string
+	for _, w := range words {
+		if w != "" {
+			alts = append(alts, regexp.QuoteMeta(w))
+		}
+	}
+	if len(alts) == 0 {
+		return nil
+	}
+	expr := "(?:" + strings.Join(alts, "|") + ")"
+	if wholeWord {
+		expr = `\b` + expr + `\b`
+	}
+	return regexp.MustCompile("(?i)" + expr)
+}
+
+// mask replaces every banned word in msg with one asterisk per character.
+func (b *Board) mask(msg string) string {
+	if b.banned == nil {
+		return msg
+	}
+	return b.banned.ReplaceAllStringFunc(msg, func(w string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(w))
+	})
 }
 
 // HandleBoard handles and serializes all events for a board. Input and output
 // channels serve as the synchronization primitive.
-// Never exits.
+// Only exits once the board is closed, by Close or by being reaped.
 func (b *Board) HandleBoard() {
-	for {
+	close(b.started)
+	defer close(b.done)
+	b.idle()
+	for !b.closing {
+		var coalesced, reap, grace, resume <-chan time.Time
+		if b.coalesceTimer != nil {
+			coalesced = b.coalesceTimer.C()
+		}
+		if b.graceTimer != nil {
+			grace = b.graceTimer.C()
+		}
+		if b.throttleTimer != nil {
+			resume = b.throttleTimer.C()
+		}
+		if b.reapTimer != nil {
+			reap = b.reapTimer.C()
+		}
 		select {
+		case <-coalesced:
+			b.flushPresence()
+		case <-grace:
+			b.graceOver()
+		case <-resume:
+			b.resume()
+		case <-b.evictCh:
+			b.evict()
+		case <-reap:
+			b.reapTimer = nil
+			if len(b.clients) == 0 && len(b.waiting) == 0 && b.onReap(b) {
+				fmt.Printf("reaping idle board [%s]\n", b.Name)
+				b.shutdown()
+			}
 		case m := <-b.wakeupCh:
+			if b.mergedInto != nil {
+				b.forwardMerged(m)
+				continue
+			}
 			switch m.Type {
 			case LOGIN:
-				fmt.Printf("login from [%s]\n", m.Name)
-				b.clients[m.Name] = m.ReplyCh
+				b.handleLogin(m)
 			case LOGOUT:
 				fmt.Printf("logout from [%s]\n", m.Name)
+				b.release(b.clients[m.Name], m.left)
 				delete(b.clients, m.Name)
+				b.lastPresence[m.Name] = b.cfg.clock().Now()
+				b.countChanged()
+				b.event(EventLogout, m.Name, "")
+				b.logMembership(m.Name, false)
+				b.presence(m.Name, false)
+				b.notifyWatchers(m.Name, "went offline")
+				b.unwatchAll(m.Name)
+				if b.admin == m.Name {
+					b.setAdmin(b.oldest())
+				}
+				b.admitWaiting()
+				b.idle()
 			case TEXTLINE:
 				fmt.Printf("msg from [%s]\n", m.Name)
-				for name, ch := range b.clients {
-					if name == m.Name {
-						continue
+				// A blank line is just someone pressing enter.
+				if strings.TrimSpace(m.Msg) == "" {
+					fmt.Printf("  blank, drop for [%s]\n", m.Name)
+					if b.cfg.NotifyBlank {
+						b.tell(m.Name, "blank message not sent")
+					}
+					continue
+				}
+				if reason := b.tooLong(m.Msg); reason != "" {
+					fmt.Printf("  too long, drop for [%s]\n", m.Name)
+					b.tell(m.Name, reason)
+					continue
+				}
+				if m.Parent != 0 && !b.inHistory(m.Parent) {
+					fmt.Printf("  no message #%d, drop reply for [%s]\n", m.Parent, m.Name)
+					b.tell(m.Name, fmt.Sprintf("there is no message #%d to reply to", m.Parent))
+					continue
+				}
+				now := b.cfg.clock().Now()
+				if b.flooding(m.Name, now) {
+					fmt.Printf("  flood drop for [%s]\n", m.Name)
+					continue
+				}
+				if last, ok := b.lastMessage[m.Name]; ok && b.slowMode > 0 && now.Sub(last) < b.slowMode {
+					fmt.Printf("  slow mode drop for [%s]\n", m.Name)
+					wait := (b.slowMode - now.Sub(last)).Round(time.Second)
+					b.throttled(m.Name, fmt.Sprintf("slow down, you can send again in %s", wait), last.Add(b.slowMode))
+					continue
+				}
+				b.lastMessage[m.Name] = now
+				if c := b.clients[m.Name]; c != nil {
+					c.sent++
+					m.Nick = c.nick
+				}
+				m.Time = now
+				m.Msg = b.mask(m.Msg)
+				b.seq++
+				m.Seq = b.seq
+				m.tmpl = b.tmpl
+				b.event(EventMessage, m.Name, m.Msg)
+				shadow := b.shadowed(m.Name)
+				if !shadow {
+					b.remember(m)
+				}
+				if b.cfg.Ack == AckQueued {
+					b.ack(m)
+				}
+				var mentioned map[string]bool
+				if !shadow {
+					mentioned = b.mentions(m.Name, m.Msg)
+				}
+				delivered := true
+				for _, f := range b.fragment(m) {
+					if !b.broadcast(f, mentioned) {
+						delivered = false
 					}
-					fmt.Printf("  fwd to [%s]\n", name)
-					ch <- m
 				}
+				b.ping(m.Name, mentioned)
+				if b.cfg.Ack == AckDelivered && delivered {
+					b.ack(m)
+				}
+			case TYPING:
+				for name, c := range b.clients {
+					if name != m.Name && !b.shadowed(m.Name) {
+						b.deliver(name, c, m)
+					}
+				}
+			case QUERY:
+				m.fn()
+			case PING:
+				m.ReplyCh <- m
+			}
+		}
+	}
+}
+
+// idle starts the reap timer if the board is empty and may be reaped.
+func (b *Board) idle() {
+	if b.onReap == nil || b.cfg.ReapAfter <= 0 || b.reapTimer != nil {
+		return
+	}
+	if len(b.clients) == 0 && len(b.waiting) == 0 {
+		b.reapTimer = b.cfg.clock().NewTimer(b.cfg.ReapAfter)
+	}
+}
+
+// shutdown makes HandleBoard return once the current event is done. Timers
+// are stopped here, on the board goroutine, so that none fires against a
+// board that is gone, and waiting logins are turned away.
+func (b *Board) shutdown() {
+	b.closing = true
+	if b.budget != nil {
+		b.budget.dropBoard(b)
+	}
+	for _, t := range []Timer{b.reapTimer, b.coalesceTimer, b.graceTimer, b.throttleTimer} {
+		if t != nil {
+			t.Stop()
+		}
+	}
+	b.reapTimer = nil
+	b.coalesceTimer = nil
+	b.graceTimer = nil
+	b.throttleTimer = nil
+	for _, m := range b.waiting {
+		m.errCh <- ErrBoardClosed
+	}
+	b.waiting = nil
+	b.farewell()
+	for _, c := range b.clients {
+		b.release(c, nil)
+	}
+}
+
+// farewellWait bounds how long shutdown waits, in all, for clients to take
+// the notice that the room is closed.
+const farewellWait = 100 * time.Millisecond
+
+// farewell tells everyone here that the room is closed. A client that is
+// not reading is not waited on for longer than farewellWait, so that it cannot
+// stall the shutdown; once that has run out, clients that cannot take the
+// notice straight away go without.
+func (b *Board) farewell() {
+	if len(b.clients) == 0 {
+		return
+	}
+	n := &Notification{Type: NOTICE, Msg: ErrBoardClosed.Error(), Priority: PriorityHigh, last: true}
+	t := b.cfg.clock().NewTimer(farewellWait)
+	defer t.Stop()
+	expired := false
+	for name, c := range b.clients {
+		if c.out != nil {
+			c.out.push(n)
+			continue
+		}
+		if !expired {
+			select {
+			case c.ch <- n:
+				continue
+			case <-t.C():
+				expired = true
+			}
+		}
+		select {
+		case c.ch <- n:
+		default:
+			fmt.Printf("  [%s] not reading, closing without telling them\n", name)
+		}
+	}
+}
+
+// release stops sending to c, which is leaving, and closes left once nothing
+// more will reach it. c may be nil.
+func (b *Board) release(c *client, left chan struct{}) {
+	if c != nil && c.out != nil {
+		c.out.close(left)
+	} else if left != nil {
+		close(left)
+	}
+}
+
+// Close stops the board's goroutine and waits for it to exit. Afterwards
+// logins fail with ErrBoardClosed and everything else sent to the board is
+// ignored. Closing a closed board does nothing.
+func (b *Board) Close() {
+	if b.post(&Notification{Type: QUERY, fn: b.shutdown}) == ErrBoardNotStarted {
+		return
+	}
+	<-b.done
+}
+
+// Announce sends msg as a system notice to everyone on the board.
+func (b *Board) Announce(msg string) {
+	b.post(&Notification{Type: QUERY, fn: func() { b.announce(msg) }})
+}
+
+// startWait bounds how long the board's methods wait for HandleBoard to be
+// started. It is real time, since it is only how long a goroutine may take to
+// get going.
+const startWait = time.Second
+
+// post hands m to the board goroutine. It fails with ErrBoardClosed if the
+// board has been closed, or with ErrBoardNotStarted if HandleBoard is not
+// running within startWait.
+func (b *Board) post(m *Notification) error {
+	select {
+	case <-b.started:
+	default:
+		t := time.NewTimer(startWait)
+		defer t.Stop()
+		select {
+		case <-b.started:
+		case <-b.done:
+			return ErrBoardClosed
+		case <-t.C:
+			return ErrBoardNotStarted
+		}
+	}
+	select {
+	case b.wakeupCh <- m:
+		return nil
+	case <-b.done:
+		return ErrBoardClosed
+	}
+}
+
+// handleLogin logs in the client asked for by a LOGIN, or turns it away. A
+// login that finds the room full waits in line if the board has a
+// WaitQueueSize, and is answered when admitWaiting lets it in.
+func (b *Board) handleLogin(m *Notification) {
+	if b.locked {
+		fmt.Printf("room locked for [%s]\n", m.Name)
+		m.errCh <- ErrRoomLocked
+		return
+	}
+	if m.Name == "" {
+		if !b.cfg.AllowAnonymous {
+			m.errCh <- ErrNameRequired
+			return
+		}
+		m.Name = b.guestName()
+	}
+	if max := b.cfg.MaxNameLength; max > 0 && utf8.RuneCountInString(m.Name) > max {
+		if !b.cfg.TruncateNames {
+			m.errCh <- ErrNameTooLong
+			return
+		}
+		m.Name = b.truncateName(m.Name)
+	}
+	// The board goroutine is the only place that can decide a name
+	// collision without racing.
+	if b.nameInUse(m.Name) {
+		fmt.Printf("login collision for [%s]\n", m.Name)
+		m.errCh <- ErrNameTaken
+		return
+	}
+	if b.cfg.MaxClients > 0 && len(b.clients) >= b.cfg.MaxClients {
+		if len(b.waiting) < b.cfg.WaitQueueSize {
+			fmt.Printf("room full, [%s] waits\n", m.Name)
+			b.waiting = append(b.waiting, m)
+			b.position(m, len(b.waiting))
+			return
+		}
+		fmt.Printf("room full for [%s]\n", m.Name)
+		m.errCh <- ErrRoomFull
+		return
+	}
+	fmt.Printf("login from [%s]\n", m.Name)
+	if b.reapTimer != nil {
+		b.reapTimer.Stop()
+		b.reapTimer = nil
+	}
+	b.joins++
+	c := &client{ch: m.ReplyCh, joined: b.joins, from: m.from}
+	if b.cfg.DeliveryWorkers || b.cfg.Overflow == DropOldest {
+		c.out = newOutbox(m.ReplyCh)
+	}
+	b.clients[m.Name] = c
+	b.lastPresence[m.Name] = b.cfg.clock().Now()
+	b.countChanged()
+	b.event(EventLogin, m.Name, "")
+	b.logMembership(m.Name, true)
+	m.errCh <- nil
+	b.replay(m.Name, c)
+	b.presence(m.Name, true)
+	b.notifyWatchers(m.Name, "is now online")
+	// The first one in runs the room.
+	if b.admin == "" {
+		b.admin = m.Name
+	}
+}
+
+// admitWaiting lets in as many waiting logins as there is room for, oldest
+// first, and tells the rest their new place in line. Nobody is let in while
+// the room is locked.
+func (b *Board) admitWaiting() {
+	if b.locked {
+		return
+	}
+	moved := false
+	for len(b.waiting) > 0 && len(b.clients) < b.cfg.MaxClients {
+		m := b.waiting[0]
+		b.waiting = b.waiting[1:]
+		moved = true
+		b.handleLogin(m)
+	}
+	if moved {
+		for i, m := range b.waiting {
+			b.position(m, i+1)
+		}
+	}
+}
+
+// position tells a waiting login its place in line, replacing any update it
+// has not read yet so that the board never waits on it.
+func (b *Board) position(m *Notification, pos int) {
+	if m.posCh == nil {
+		return
+	}
+	select {
+	case <-m.posCh:
+	default:
+	}
+	m.posCh <- pos
+}
+
+func (b *Board) isWaiting(name string) bool {
+	for _, m := range b.waiting {
+		if m.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// event records something that happened on this board to the event stream.
+func (b *Board) event(t EventType, name, msg string) {
+	b.cfg.Events.emit(Event{
+		Type:  t,
+		Time:  b.cfg.clock().Now(),
+		Board: b.Name,
+		Name:  name,
+		Msg:   msg,
+	})
+}
+
+// presence announces that name joined or left the board. A leave first waits
+// out the LeaveGrace, and is dropped along with the join if name comes back
+// within it.
+func (b *Board) presence(name string, joined bool) {
+	if !b.cfg.PresenceNotices {
+		return
+	}
+	switch {
+	case joined && b.rejoined(name):
+		return
+	case !joined && b.cfg.LeaveGrace > 0:
+		b.leaveLater(name)
+		return
+	}
+	b.announcePresence(name, joined)
+}
+
+// announcePresence sends a join or leave notice. With a CoalesceWindow the
+// notice is held back and combined with any others that arrive before the
+// window closes.
+func (b *Board) announcePresence(name string, joined bool) {
+	if b.cfg.CoalesceWindow <= 0 {
+		msg := name + " left"
+		if joined {
+			msg = name + " joined"
+		}
+		for n, c := range b.clients {
+			if n != name {
+				b.deliver(n, c, notice(msg))
+			}
+		}
+		return
+	}
+	if joined {
+		b.pendingJoins = append(b.pendingJoins, name)
+	} else {
+		b.pendingLeaves = append(b.pendingLeaves, name)
+	}
+	if b.coalesceTimer == nil {
+		b.coalesceTimer = b.cfg.clock().NewTimer(b.cfg.CoalesceWindow)
+	}
+}
+
+// notifyWatchers privately tells everyone watching name what happened.
+func (b *Board) notifyWatchers(name, what string) {
+	for w := range b.watchers[name] {
+		if c := b.clients[w]; c != nil {
+			b.deliver(w, c, notice(name+" "+what))
+		}
+	}
+}
+
+// unwatchAll drops every watch held by watcher.
+func (b *Board) unwatchAll(watcher string) {
+	for target, ws := range b.watchers {
+		delete(ws, watcher)
+		if len(ws) == 0 {
+			delete(b.watchers, target)
+		}
+	}
+}
+
+// flushPresence sends the notices batched up by presence.
+func (b *Board) flushPresence() {
+	b.coalesceTimer = nil
+	b.announceBatch(b.pendingJoins, " joined")
+	b.announceBatch(b.pendingLeaves, " left")
+	b.pendingJoins = nil
+	b.pendingLeaves = nil
+}
+
+// announceBatch tells every client about names, leaving each client's own
+// name out as the uncoalesced notices do.
+func (b *Board) announceBatch(names []string, what string) {
+	if len(names) == 0 {
+		return
+	}
+	for name, c := range b.clients {
+		var others []string
+		for _, n := range names {
+			if n != name {
+				others = append(others, n)
+			}
+		}
+		if len(others) > 0 {
+			b.deliver(name, c, notice(strings.Join(others, ", ")+what))
+		}
+	}
+}
+
+// setAdmin hands the room to name, or leaves it without an admin if name is
+// empty, and tells everyone.
+func (b *Board) setAdmin(name string) {
+	b.admin = name
+	if name != "" {
+		fmt.Printf("admin is now [%s]\n", name)
+		b.announce(name + " is now the room admin")
+	}
+}
+
+// oldest returns the longest logged in client, or "" if there are none.
+func (b *Board) oldest() string {
+	var name string
+	var joined uint64
+	for n, c := range b.clients {
+		if name == "" || c.joined < joined {
+			name, joined = n, c.joined
+		}
+	}
+	return name
+}
+
+// tell sends a system notice to name alone, if they are logged in.
+func (b *Board) tell(name, msg string) {
+	b.sendTo(name, notice(msg))
+}
+
+// sendTo delivers n to name, if they are here.
+func (b *Board) sendTo(name string, n *Notification) {
+	if c := b.clients[name]; c != nil {
+		b.deliver(name, c, n)
+	}
+}
+
+// tooLong explains why msg breaks the length limits, or returns "" if it
+// does not.
+func (b *Board) tooLong(msg string) string {
+	if max := b.cfg.MaxMessageBytes; max > 0 && len(msg) > max {
+		return fmt.Sprintf("message too long, the limit is %d bytes", max)
+	}
+	if max := b.cfg.MaxMessageRunes; max > 0 && utf8.RuneCountInString(msg) > max {
+		return fmt.Sprintf("message too long, the limit is %d characters", max)
+	}
+	return ""
+}
+
+// announce sends a system notice to every client on the board.
+func (b *Board) announce(msg string) {
+	for name, c := range b.clients {
+		b.deliver(name, c, alert(msg))
+	}
+}
+
+// broadcast sends m to every client except its author, unless the board has
+// EchoToSender, marking the copies for those in mentioned. Clients are served
+// in deliveryOrder. Reports whether every one of them got it.
+func (b *Board) broadcast(m *Notification, mentioned map[string]bool) bool {
+	ok := true
+	shadow := b.shadowed(m.Name)
+	for _, role := range deliveryOrder {
+		for name, c := range b.clients {
+			if name == m.Name && !b.cfg.EchoToSender || b.roleOf(name, c) != role {
+				continue
+			}
+			if shadow && name != m.Name {
+				continue
+			}
+			fmt.Printf("  fwd to [%s]\n", name)
+			n := m
+			if mentioned[name] {
+				hl := *m
+				hl.Mention = true
+				n = &hl
+			}
+			if !b.deliver(name, c, n) {
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// fragment splits a message longer than FragmentSize bytes into numbered
+// parts sharing the original Seq. Splits fall on rune boundaries.
+func (b *Board) fragment(m *Notification) []*Notification {
+	size := b.cfg.FragmentSize
+	if size <= 0 || len(m.Msg) <= size {
+		return []*Notification{m}
+	}
+	var chunks []string
+	for msg := m.Msg; msg != ""; {
+		n := size
+		if n >= len(msg) {
+			n = len(msg)
+		} else {
+			for n > 0 && !utf8.RuneStart(msg[n]) {
+				n--
+			}
+			if n == 0 {
+				// a single rune wider than size
+				_, n = utf8.DecodeRuneInString(msg)
 			}
 		}
+		chunks = append(chunks, msg[:n])
+		msg = msg[n:]
+	}
+	frags := make([]*Notification, len(chunks))
+	for i, chunk := range chunks {
+		f := *m
+		f.Msg = chunk
+		f.Part = i + 1
+		f.Parts = len(chunks)
+		frags[i] = &f
+	}
+	return frags
+}
+
+// OnCountChange registers fn to be called with the new number of clients
+// whenever a login or logout changes it, replacing any earlier callback. The
+// board must be running. fn runs on the board goroutine, so it must not
+// block; hand the value off to another goroutine if real work is needed.
+// Config.OnCountChange covers boards that are started by a registry.
+func (b *Board) OnCountChange(fn func(n int)) {
+	b.query(func() {
+		b.countFn = fn
+	})
+}
+
+// countChanged is called on the board goroutine after every change to the
+// set of clients.
+func (b *Board) countChanged() {
+	b.publishStats()
+	if b.countFn != nil {
+		b.countFn(len(b.clients))
+	}
+}
+
+// ack tells the publisher of m that it was accepted. A publisher on the board
+// is sent the ACK through its send queue like anything else, but would take
+// one dropped for a full queue as the message being lost, and so is
+// disconnected instead. The board never waits on anyone else's AckCh: with
+// no room the ACK is dropped.
+func (b *Board) ack(m *Notification) {
+	if m.AckCh == nil {
+		return
+	}
+	n := &Notification{
+		Type: ACK,
+		Name: m.Name,
+		Seq:  m.Seq,
+	}
+	if c := b.clients[m.Name]; c != nil && c.ch == m.AckCh {
+		if !b.deliver(m.Name, c, n) {
+			b.hangup(m.Name, c)
+		}
+		return
+	}
+	select {
+	case m.AckCh <- n:
+	default:
+		fmt.Printf("  drop ack for [%s], ack channel full\n", m.Name)
+	}
+}
+
+// send queues n on ch. When clients have a bounded send queue a full queue
+// drops n rather than stalling the board. Reports whether n was queued.
+func (b *Board) send(ch chan<- *Notification, n *Notification) bool {
+	if b.cfg.SendQueueSize <= 0 {
+		ch <- n
+		return true
+	}
+	select {
+	case ch <- n:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver sends n to a single client and tracks its queue depth against the
+// watermarks. Queue depth is only sampled here, so a drained queue is noticed
+// on the next delivery. Reports whether n was queued.
+func (b *Board) deliver(name string, c *client, n *Notification) bool {
+	var ok bool
+	if c.out != nil {
+		// PriorityHigh jumps the queue, and so is never held up by it.
+		if ok = n.Priority == PriorityHigh || b.cfg.SendQueueSize <= 0 || c.out.len() < b.cfg.SendQueueSize; ok {
+			c.out.push(n)
+		} else if b.cfg.Overflow == DropOldest {
+			fmt.Printf("  drop oldest for [%s], send queue full\n", name)
+			c.out.dropOldest()
+			c.out.push(n)
+			ok = true
+		}
+	} else if c.role == RoleSpectator {
+		// A spectator never holds up the room.
+		select {
+		case c.ch <- n:
+			ok = true
+		default:
+		}
+	} else {
+		// Nothing can jump a channel's queue, so PriorityHigh waits its
+		// turn, or is dropped, like anything else.
+		ok = b.send(c.ch, n)
+	}
+	if !ok {
+		fmt.Printf("  drop for [%s], send queue full\n", name)
+		if b.cfg.Overflow == DisconnectSlow {
+			b.hangup(name, c)
+		}
+	}
+	b.watermark(name, c)
+	return ok
+}
+
+// hangup closes the connection of a client that cannot keep up. Its session
+// then logs it out as for any other lost connection.
+func (b *Board) hangup(name string, c *client) {
+	if c.hungUp || c.from == nil || c.from.hangup == nil {
+		return
+	}
+	c.hungUp = true
+	fmt.Printf("  disconnecting [%s], send queue full\n", name)
+	c.from.hangup()
+}
+
+func (b *Board) watermark(name string, c *client) {
+	if b.cfg.HighWatermark <= 0 {
+		return
+	}
+	depth := len(c.ch)
+	if c.out != nil {
+		depth = c.out.len()
+	}
+	switch {
+	case !c.congested && depth >= b.cfg.HighWatermark:
+		c.congested = true
+		fmt.Printf("  send queue for [%s] above high watermark (%d)\n", name, depth)
+	case c.congested && depth <= b.cfg.LowWatermark:
+		c.congested = false
+		fmt.Printf("  send queue for [%s] drained (%d)\n", name, depth)
+	}
+}
+
+// query runs fn on the board goroutine and waits for it to finish, giving
+// fn safe access to the board's state. On a closed board fn is not run.
+func (b *Board) query(fn func()) {
+	done := make(chan struct{})
+	if b.post(&Notification{
+		Type: QUERY,
+		fn: func() {
+			fn()
+			close(done)
+		},
+	}) == nil {
+		<-done
+	}
+}
+
+// has reports whether name is logged in to the board. It is false for a
+// closed board.
+func (b *Board) has(name string) bool {
+	var ok bool
+	b.query(func() { _, ok = b.clients[name] })
+	return ok
+}
+
+// Seen reports when name last logged in or out, when they last said
+// something, and whether they are logged in now. said is zero if they have
+// not spoken. ok is false if the board has never seen name.
+func (b *Board) Seen(name string) (presence, said time.Time, online, ok bool) {
+	b.query(func() {
+		presence, ok = b.lastPresence[name]
+		said = b.lastMessage[name]
+		_, online = b.clients[name]
+	})
+	return
+}
+
+// Admin returns the name of the room admin, or "" if the board is empty.
+func (b *Board) Admin() string {
+	var admin string
+	b.query(func() {
+		admin = b.admin
+	})
+	return admin
+}
+
+// Grant transfers the admin role from from, who must hold it, to to, who
+// must be logged in.
+func (b *Board) Grant(from, to string) error {
+	var err error
+	b.query(func() {
+		switch {
+		case b.admin != from:
+			err = ErrNotAdmin
+		case b.clients[to] == nil:
+			err = ErrNoSuchUser
+		default:
+			b.setAdmin(to)
+		}
+	})
+	return err
+}
+
+// Ban adds a user name or IP to the server's ban list on behalf of a server
+// operator. Banned users are refused at their next login.
+func (b *Board) Ban(by, entry string) error {
+	return b.changeBans(by, entry, b.cfg.Bans.Ban)
+}
+
+// Unban removes a user name or IP from the ban list on behalf of a server
+// operator.
+func (b *Board) Unban(by, entry string) error {
+	return b.changeBans(by, entry, b.cfg.Bans.Unban)
+}
+
+func (b *Board) changeBans(by, entry string, change func(string) error) error {
+	if b.cfg.Bans == nil {
+		return ErrNoBanList
+	}
+	// The ban list covers every room and outlives the process, so it is
+	// not enough to be the admin of this one.
+	if !b.cfg.isOperator(by) {
+		return ErrNotOperator
 	}
+	// The ban list may write to disk, so it is changed off the board
+	// goroutine. It has its own lock.
+	if err := change(entry); err != nil {
+		fmt.Printf("updating ban list: %s\n", err)
+		return err
+	}
+	fmt.Printf("ban list changed for [%s] by [%s]\n", entry, by)
+	return nil
+}
+
+// Topic returns the board's topic.
+func (b *Board) Topic() string {
+	var topic string
+	b.query(func() {
+		topic = b.topic
+	})
+	return topic
+}
+
+// SetTopic changes the topic, on behalf of the admin, and tells everyone.
+func (b *Board) SetTopic(by, topic string) error {
+	var err error
+	b.query(func() {
+		if by != b.admin {
+			err = ErrNotAdmin
+			return
+		}
+		b.topic = topic
+		b.announce(by + " set the topic: " + topic)
+	})
+	return err
+}
+
+// SlowMode returns the least time allowed between two messages from the same
+// user, or zero if slow mode is off.
+func (b *Board) SlowMode() time.Duration {
+	var d time.Duration
+	b.query(func() {
+		d = b.slowMode
+	})
+	return d
+}
+
+// SetSlowMode changes the slow mode interval, on behalf of the admin, and
+// tells everyone. Zero turns slow mode off.
+func (b *Board) SetSlowMode(by string, d time.Duration) error {
+	var err error
+	b.query(func() {
+		if by != b.admin {
+			err = ErrNotAdmin
+			return
+		}
+		b.slowMode = d
+		if d > 0 {
+			b.announce(fmt.Sprintf("%s set slow mode to one message per %s", by, d))
+		} else {
+			b.announce(by + " turned slow mode off")
+		}
+	})
+	return err
+}
+
+// Watch asks for watcher to be told whenever target logs in or out, until
+// watcher itself logs out. target need not be online.
+func (b *Board) Watch(watcher, target string) {
+	b.query(func() {
+		ws := b.watchers[target]
+		if ws == nil {
+			ws = make(map[string]bool)
+			b.watchers[target] = ws
+		}
+		ws[watcher] = true
+	})
+}
+
+// Unwatch cancels a Watch.
+func (b *Board) Unwatch(watcher, target string) {
+	b.query(func() {
+		delete(b.watchers[target], watcher)
+		if len(b.watchers[target]) == 0 {
+			delete(b.watchers, target)
+		}
+	})
+}
+
+// Report privately tells the room admin that from is reporting target for
+// reason. Each reporter may send one report per ReportInterval.
+func (b *Board) Report(from, target, reason string) error {
+	var err error
+	b.query(func() {
+		now := b.cfg.clock().Now()
+		last, ok := b.lastReport[from]
+		switch {
+		case b.clients[target] == nil:
+			err = ErrNoSuchUser
+		case ok && now.Sub(last) < b.cfg.ReportInterval:
+			err = ErrRateLimited
+		default:
+			b.lastReport[from] = now
+			fmt.Printf("report from [%s] about [%s]\n", from, target)
+			if c := b.clients[b.admin]; c != nil {
+				msg := fmt.Sprintf("report from %s about %s: %s", from, target, reason)
+				b.deliver(b.admin, c, alert(msg))
+			}
+		}
+	})
+	return err
+}
+
+// SetAway marks name as away with msg, or as back if msg is empty.
+func (b *Board) SetAway(name, msg string) error {
+	err := ErrNoSuchUser
+	b.query(func() {
+		if c := b.clients[name]; c != nil {
+			c.away = msg
+			err = nil
+		}
+	})
+	return err
+}
+
+// Who describes everyone on the board for /who, in sorted order, with the
+// away message of anyone who is away.
+func (b *Board) Who() []string {
+	var who []string
+	b.query(func() {
+		for _, name := range sortedNames(b.clients) {
+			if away := b.clients[name].away; away != "" {
+				name += " (away: " + away + ")"
+			}
+			who = append(who, name)
+		}
+	})
+	return who
+}
+
+// Direct sends msg from from to the client called to alone. If receipt is
+// set it is closed once the message has been written to the recipient's
+// connection, which only Serve does; an in-process Client never closes it.
+// Fails with ErrNoSuchUser if to is not logged in.
+func (b *Board) Direct(from, to, msg string, receipt chan struct{}) error {
+	err := ErrNoSuchUser
+	b.query(func() {
+		c := b.clients[to]
+		if c == nil {
+			return
+		}
+		if reason := b.tooLong(msg); reason != "" {
+			err = errors.New(reason)
+			return
+		}
+		fmt.Printf("direct msg from [%s] to [%s]\n", from, to)
+		err = nil
+		n := &Notification{Type: DIRECT, Name: from, Msg: b.mask(msg), receipt: receipt}
+		if sender := b.clients[from]; sender != nil {
+			n.Nick = sender.nick
+		}
+		if !b.deliver(to, c, n) {
+			err = ErrNotDelivered
+		}
+		if c.away != "" {
+			b.tell(from, to+" is away: "+c.away)
+		}
+	})
+	return err
 }
 
 // Login adds a user to a board to be notified of messages.
 // replyCh - a channel on which a subscribed goroutine will listen for new
 // messages.
-func (b *Board) Login(name string, replyCh chan<- *Notification) {
-	b.wakeupCh <- &Notification{
+// Returns ErrNameTaken if the name is already logged in, in which case
+// replyCh is not used. If the room is full and has a WaitQueueSize, Login
+// waits in line until there is room.
+func (b *Board) Login(name string, replyCh chan<- *Notification) error {
+	_, err := b.login(name, nil, replyCh, nil)
+	return err
+}
+
+// LoginAnonymous is like Login but has the board pick a unique guest name,
+// which is returned. Fails with ErrNameRequired unless the board allows
+// anonymous logins.
+func (b *Board) LoginAnonymous(replyCh chan<- *Notification) (string, error) {
+	return b.login("", nil, replyCh, nil)
+}
+
+// login returns the name the board actually logged in, which differs from
+// name for anonymous logins. While the login waits for room in a full board,
+// waitFn, if set, is called with its place in line whenever that changes.
+func (b *Board) login(name string, from *origin, replyCh chan<- *Notification, waitFn func(pos int)) (string, error) {
+	errCh := make(chan error, 1)
+	m := &Notification{
 		Type:    LOGIN,
 		Name:    name,
 		ReplyCh: replyCh,
+		errCh:   errCh,
+		from:    from,
+	}
+	if waitFn != nil {
+		m.posCh = make(chan int, 1)
+	}
+	if err := b.post(m); err != nil {
+		return "", err
+	}
+	for {
+		select {
+		case pos := <-m.posCh:
+			waitFn(pos)
+		case err := <-errCh:
+			if err != nil {
+				return "", err
+			}
+			// The receive above orders this read after the board's
+			// write.
+			return m.Name, nil
+		}
 	}
 }
 
-// Logout removes a user from a board
+// Logout removes a user from a board. Once it returns nothing more is sent
+// on the user's channel. With DeliveryWorkers that means waiting for what is
+// still queued for them to be taken off the channel.
 func (b *Board) Logout(name string) {
-	b.wakeupCh <- &Notification{
+	left := make(chan struct{})
+	if b.post(&Notification{
 		Type: LOGOUT,
 		Name: name,
+		left: left,
+	}) == nil {
+		<-left
 	}
 }
 
-// Publish sends a message to a board to be published to others
-func (b *Board) Publish(name, msg string) {
-	b.wakeupCh <- &Notification{
-		Type: TEXTLINE,
-		Name: name,
-		Msg:  msg,
-	}
+// Publish sends a message to a board to be published to others. It fails
+// with ErrBoardClosed or ErrBoardNotStarted if there is no board goroutine
+// to take it.
+func (b *Board) Publish(name, msg string) error {
+	return b.PublishAck(name, msg, nil)
+}
+
+// PublishAck is like Publish, but if the board has acknowledgements enabled
+// an ACK for the message is sent on ackCh.
+func (b *Board) PublishAck(name, msg string, ackCh chan<- *Notification) error {
+	return b.post(&Notification{
+		Type:  TEXTLINE,
+		Name:  name,
+		Msg:   msg,
+		AckCh: ackCh,
+	})
+}
+
+// Typing tells the others on the board that name is typing. Only clients
+// that advertised the typing capability are shown it.
+func (b *Board) Typing(name string) {
+	b.post(&Notification{Type: TYPING, Name: name})
+}
+
+// Reply publishes msg as a reply to the message numbered parent, which must
+// still be in the board's history. The sender is told if it is not. Acks
+// are sent on ackCh as for PublishAck.
+func (b *Board) Reply(name string, parent uint64, msg string, ackCh chan<- *Notification) {
+	b.post(&Notification{
+		Type:   TEXTLINE,
+		Name:   name,
+		Msg:    msg,
+		AckCh:  ackCh,
+		Parent: parent,
+	})
+}
+
+// Ephemeral publishes msg for those here now only, to be hidden after ttl.
+// Acks are sent on ackCh as for PublishAck.
+func (b *Board) Ephemeral(name, msg string, ttl time.Duration, ackCh chan<- *Notification) {
+	b.post(&Notification{
+		Type:  TEXTLINE,
+		Name:  name,
+		Msg:   msg,
+		AckCh: ackCh,
+		TTL:   ttl,
+	})
 }
 
 // Serve handles the communication for an individual client.
-// One additional helper goroutine is created.
+// One additional helper goroutine is created per login.
 func Serve(b *Board, conn net.Conn) {
 	// Ensure the handle is freed, regardless of how we exit.
 	defer conn.Close()
 
-	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	// Middleware sits next to the conn, beneath any compression, and sees
+	// the bytes as they cross the wire.
+	var in io.Reader = conn
+	if b.cfg.WrapReader != nil {
+		in = b.cfg.WrapReader(in)
+	}
+	var raw io.Writer = &retryWriter{w: conn}
+	if b.cfg.WrapWriter != nil {
+		raw = b.cfg.WrapWriter(raw)
+	}
+	reader := bufio.NewReader(in)
+	writer := bufio.NewWriter(raw)
+	r := boardRender(&b.cfg.BoardConfig)
+	var p protocol = &lineProtocol{reader: reader, writer: writer, render: r}
 
-	// login prompt
-	if _, err := writer.WriteString("username> "); err != nil {
+	addr := conn.RemoteAddr().String()
+	from := &origin{addr: addr, since: b.cfg.clock().Now(), hangup: func() { conn.Close() }}
+	b.cfg.Events.emit(Event{
+		Type:  EventConnect,
+		Time:  b.cfg.clock().Now(),
+		Board: b.Name,
+		Addr:  addr,
+	})
+	ip, _, _ := net.SplitHostPort(addr)
+	if b.cfg.Bans.Banned("", ip) {
+		refuse(p, "you are banned")
 		return
 	}
-	if err := writer.Flush(); err != nil {
-		return
+
+	// Behind an auth proxy the name comes from the proxy instead.
+	var identity string
+	if b.cfg.ProxyIdentity {
+		var err error
+		if identity, err = readIdentity(reader); err != nil {
+			fmt.Printf("no identity from proxy at %s: %s\n", addr, err)
+			refuse(p, "no identity from the proxy")
+			return
+		}
+		if b.cfg.Bans.Banned(identity, ip) {
+			refuse(p, "you are banned")
+			return
+		}
 	}
-	name, err := reader.ReadString('\n')
-	if err != nil {
-		return
+	wait := func(pos int) {
+		p.WriteNotification(notice(fmt.Sprintf("room is full, you are number %d in line", pos)))
+		p.Flush()
 	}
-	name = strings.TrimSpace(name)
 
 	// Add ourselves to the board to be notified when someone posts a
-	// message
-	reply := make(chan *Notification)
-	b.Login(name, reply)
+	// message. Keep prompting until we get a name nobody else is using.
+	// With ReauthOnExpiry we come back here when the session runs out.
+	var caps capabilities
+	for first := true; ; {
+		reply := make(chan *Notification, b.cfg.SendQueueSize)
+		var name string
+		for ; ; first = false {
+			if identity != "" {
+				// The proxy vouches for the name, so there is nobody
+				// to prompt.
+				var err error
+				if name, err = b.login(identity, from, reply, wait); err != nil {
+					refuse(p, err.Error())
+					return
+				}
+				break
+			}
+			// login prompt
+			if err := p.Prompt("username"); err != nil {
+				return
+			}
+			if first && b.cfg.Compression {
+				cr, cw, err := negotiateCompression(reader, writer, raw)
+				if err != nil {
+					return
+				}
+				reader, writer = cr, cw
+				p = &lineProtocol{reader: reader, writer: writer, render: r}
+			}
+			line, err := p.ReadLine()
+			if err != nil {
+				return
+			}
+			if first {
+				if v, ok := handshake(line, reader, writer, r); ok {
+					p = v
+					continue
+				}
+			}
+			if c, ok := parseCapabilities(line); ok {
+				caps = c
+				if caps["crlf"] {
+					r.crlf = true
+					if lp, ok := p.(*lineProtocol); ok {
+						lp.render.crlf = true
+					}
+				}
+				continue
+			}
+			requested := strings.TrimSpace(line)
+			if b.cfg.Bans.Banned(requested, ip) {
+				refuse(p, "you are banned")
+				return
+			}
+			name, err = b.login(requested, from, reply, wait)
+			if err == nil {
+				if name != requested || caps["welcome"] {
+					p.WriteNotification(notice("you are " + name))
+					p.Flush()
+				}
+				break
+			}
+			if err == ErrRoomFull {
+				refuseRetry(p, err.Error(), b.cfg.RetryAfter)
+				return
+			}
+			if err == ErrBoardClosed || err == ErrRoomLocked {
+				refuse(p, err.Error())
+				return
+			}
+			if err := p.WriteLine(err.Error()); err != nil {
+				return
+			}
+		}
+		first = false
+		// The session reads through p, as the login did, so that lines
+		// that arrived along with the name are still there to be read.
+		var again bool
+		if b, again = b.session(conn, p, caps, name, from, reply); !again {
+			return
+		}
+	}
+}
+
+// session runs a logged in client until it leaves. It returns true if the
+// client is to be asked to log in again on the same connection, along with
+// the board to log in to, which differs from b if the room was merged.
+func (b *Board) session(conn net.Conn, p protocol, caps capabilities, name string, from *origin, reply chan *Notification) (next *Board, again bool) {
+	addr := from.addr
+	// Once we stop writing to the client, keep consuming replies until the
+	// reader goroutine has logged us out, so the board never blocks on a
+	// client that has gone away. Closing the conn is what unblocks the
+	// reader, unless it has already been told to stop.
+	defer func() {
+		if !again {
+			conn.Close()
+		}
+		for range reply {
+		}
+	}()
+
+	// Acks come back through our own reply channel so that they are
+	// written in order with everything else.
+	var ackCh chan<- *Notification
+	if b.cfg.Ack != AckNone {
+		ackCh = reply
+	}
+
+	// Disconnect the client once it has been quiet for too long. The reader
+	// pokes active for every line it receives. With an IdleCheckInterval
+	// it notes the time in lastActive instead, and the timer only checks
+	// that every so often.
+	var idle <-chan time.Time
+	var idleTimer Timer
+	var active chan struct{}
+	var lastActive int64
+	if b.cfg.IdleTimeout > 0 {
+		if b.cfg.IdleCheckInterval > 0 {
+			atomic.StoreInt64(&lastActive, b.cfg.clock().Now().UnixNano())
+			idleTimer = b.cfg.clock().NewTimer(b.cfg.IdleCheckInterval)
+		} else {
+			idleTimer = b.cfg.clock().NewTimer(b.cfg.IdleTimeout)
+			active = make(chan struct{}, 1)
+		}
+		defer idleTimer.Stop()
+		idle = idleTimer.C()
+	}
+
+	// Sessions may also be capped regardless of activity.
+	var expired <-chan time.Time
+	if b.cfg.MaxSessionDuration > 0 {
+		sessionTimer := b.cfg.clock().NewTimer(b.cfg.MaxSessionDuration)
+		defer sessionTimer.Stop()
+		expired = sessionTimer.C()
+	}
+
+	// With a FlushInterval, what is written to the client is flushed when
+	// the interval is up rather than after every notification. Receipts are
+	// only closed once their message has been flushed.
+	var flushed <-chan time.Time
+	var flushTimer Timer
+	var receipts []chan struct{}
+	flush := func() error {
+		flushed = nil
+		if err := p.Flush(); err != nil {
+			return err
+		}
+		for _, r := range receipts {
+			close(r)
+		}
+		receipts = nil
+		return nil
+	}
+	defer func() {
+		if flushTimer != nil {
+			flushTimer.Stop()
+		}
+	}()
+
+	// leaveBy is set by the reader to the time by which a client leaving
+	// with /quit must have taken the rest of its messages.
+	var leaveBy int64
+	// relogin is set before the reader is interrupted to make the client
+	// log in again, so that it does not take the interruption for an error.
+	var relogin int32
 
 	// Run a goroutine to read from the client and post to the board.
 	// The goroutine will exit when the client closes the conn.
@@ -142,56 +1661,557 @@ func Serve(b *Board, conn net.Conn) {
 	// preventing the leaking of sockets upon client logout.  Handling of
 	// that case would require another channel for graceful cleanup (see
 	// https://blog.golang.org/pipelines)
+	// Should the room be merged into another, st follows the client there.
+	st := &seat{b: b, name: name, from: from}
 	go func() {
 		defer close(reply)
 		for {
-			line, err := reader.ReadString('\n')
+			line, err := p.ReadLine()
+			cur, name := st.settle()
 			if err != nil {
-				b.Logout(name)
+				if atomic.LoadInt32(&relogin) == 0 {
+					cur.connError(name, addr, err)
+				}
+				cur.Logout(name)
+				return
+			}
+			if b.cfg.IdleCheckInterval > 0 {
+				atomic.StoreInt64(&lastActive, b.cfg.clock().Now().UnixNano())
+			}
+			select {
+			case active <- struct{}{}:
+			default:
+			}
+			if line == "/quit" {
+				// Anything already queued for us is still written
+				// out ahead of the goodbye, but only for so long.
+				if cur.cfg.FlushTimeout > 0 {
+					atomic.StoreInt64(&leaveBy, time.Now().Add(cur.cfg.FlushTimeout).UnixNano())
+				}
+				cur.Logout(name)
+				reply <- notice("goodbye")
 				return
 			}
-			b.Publish(name, line)
+			if strings.HasPrefix(line, "/") {
+				if command(cur, name, line, p, st, reply) {
+					continue
+				}
+				if !cur.cfg.UnknownCommandsAsText {
+					cmd, _ := splitCommand(line)
+					reply <- notice("unknown command " + cmd + ", try /help")
+					continue
+				}
+			}
+			cur.PublishAck(name, line, ackCh)
 		}
 	}()
 
 	// Handle publishing of other clients messages back to this goroutines'
-	// client.
+	// client. If the board it is on is closed, there is nothing more to
+	// wait for once what it sent before closing has been written.
+	// styled is the board whose choices p renders with.
+	styled := b
 	for {
+		cur, _ := st.get()
 		select {
+		case <-cur.done:
+			if now, _ := st.get(); now != cur || len(reply) > 0 {
+				// Moved on, or still catching up.
+				continue
+			}
+			// The board's own farewell did not reach us in time.
+			p.WriteNotification(notice(ErrBoardClosed.Error()))
+			flush()
+			return nil, false
+		case <-active:
+			idleTimer.Reset(b.cfg.IdleTimeout)
+		case <-idle:
+			if b.cfg.IdleCheckInterval > 0 {
+				last := time.Unix(0, atomic.LoadInt64(&lastActive))
+				if b.cfg.clock().Now().Sub(last) < b.cfg.IdleTimeout {
+					idleTimer.Reset(b.cfg.IdleCheckInterval)
+					continue
+				}
+			}
+			p.WriteNotification(notice("disconnected for being idle"))
+			flush()
+			return nil, false
+		case <-expired:
+			if !b.cfg.ReauthOnExpiry {
+				p.WriteNotification(notice("session expired, please reconnect"))
+				flush()
+				return nil, false
+			}
+			// Stop the reader with a deadline in the past rather than by
+			// closing the conn. A line the client was halfway through
+			// sending is lost.
+			atomic.StoreInt32(&relogin, 1)
+			conn.SetReadDeadline(time.Now())
+			for range reply {
+			}
+			conn.SetReadDeadline(time.Time{})
+			p.WriteNotification(notice("session expired, please log in again"))
+			next, _ = st.get()
+			return next, true
+		case <-flushed:
+			if err := flush(); err != nil {
+				st.connError(addr, err)
+				return nil, false
+			}
 		case r, ok := <-reply:
 			if !ok {
 				// chan was closed in above goroutine
-				return
+				flush()
+				return nil, false
 			}
-			_, err := writer.WriteString(fmt.Sprintf("%s: %s", r.Name, r.Msg))
-			if err != nil {
-				return
+			if r.Type == QUERY {
+				// From the reader, for something only this goroutine
+				// may touch.
+				r.fn()
+				continue
 			}
-			if err := writer.Flush(); err != nil {
-				return
+			if r.Type == MOVED {
+				st.move(r.board, r.Name)
+				r = notice(r.Msg)
+			}
+			if !caps.wants(r) {
+				continue
+			}
+			cur, self := st.get()
+			if cur != styled {
+				// The room moved to, by /join or a merge, may show
+				// messages its own way.
+				styled = cur
+				style := boardRender(&cur.cfg.BoardConfig)
+				style.crlf = style.crlf || caps["crlf"]
+				p.Restyle(style)
+			}
+			if r.Type == TEXTLINE && r.Name == self {
+				// r is shared with every other client
+				own := *r
+				own.own = true
+				r = &own
+			}
+			if cur.cfg.EscapeMarkdown && (r.Type == TEXTLINE || r.Type == DIRECT) {
+				// r is shared with every other client
+				escaped := *r
+				escaped.Msg = escapeMarkdown(r.Msg)
+				r = &escaped
+			}
+			if deadline := writeDeadline(b.cfg.WriteTimeout, atomic.LoadInt64(&leaveBy)); !deadline.IsZero() {
+				conn.SetWriteDeadline(deadline)
+			}
+			write := p.WriteNotification
+			if r.line {
+				write = func(n *Notification) error { return p.WriteLine(n.Msg) }
+			}
+			if err := write(r); err != nil {
+				st.connError(addr, err)
+				return nil, false
+			}
+			if r.last {
+				flush()
+				return nil, false
+			}
+			if r.receipt != nil {
+				receipts = append(receipts, r.receipt)
+			}
+			if b.cfg.FlushInterval > 0 {
+				if flushed == nil {
+					if flushTimer == nil {
+						flushTimer = b.cfg.clock().NewTimer(b.cfg.FlushInterval)
+					} else {
+						flushTimer.Reset(b.cfg.FlushInterval)
+					}
+					flushed = flushTimer.C()
+				}
+				continue
+			}
+			if err := flush(); err != nil {
+				st.connError(addr, err)
+				return nil, false
 			}
 		}
 	}
 }
 
-// Single routine to accept all new connections
-func Run() {
-	// Only handle a singleton board in this implementation.
-	b := NewBoard("1")
+// setFormat returns a QUERY for the session's writer that switches p to the
+// named format and says so. The switch is queued behind anything already on
+// its way to the client.
+func setFormat(p protocol, name string) *Notification {
+	return &Notification{Type: QUERY, fn: func() {
+		msg := "format is now " + name
+		if name == "" {
+			msg = "usage: /format " + strings.Join(formats, "|")
+		} else if err := p.SetFormat(name); err != nil {
+			msg = err.Error()
+		}
+		p.WriteNotification(notice(msg))
+		p.Flush()
+	}}
+}
+
+// retryWriter keeps writing until all of a buffer is written, so that a
+// connection that takes a few bytes at a time, or fails in a way that may
+// clear up by itself, still gets everything. It sits underneath the
+// bufio.Writer, whose errors are sticky, so that one hiccup does not cost
+// the client its connection. A write that keeps failing still ends: the
+// write deadline turns into an error that is not retried, and maxWriteStalls
+// attempts in a row without progress give up.
+type retryWriter struct {
+	w io.Writer
+}
+
+// maxWriteStalls is how many writes in a row may make no progress before
+// retryWriter gives up.
+const maxWriteStalls = 10
+
+func (rw *retryWriter) Write(buf []byte) (int, error) {
+	var written, stalls int
+	for written < len(buf) {
+		n, err := rw.w.Write(buf[written:])
+		written += n
+		if err != nil && !transient(err) {
+			return written, err
+		}
+		if n > 0 {
+			stalls = 0
+			continue
+		}
+		if stalls++; stalls == maxWriteStalls {
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// transient reports whether a write error is worth retrying: a short write,
+// or a system call that was interrupted or would have blocked. Timeouts are
+// not: they mean the client is not keeping up.
+func transient(err error) bool {
+	return errors.Is(err, io.ErrShortWrite) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN)
+}
+
+// temporary reports whether an accept error may clear up by itself.
+func temporary(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && (ne.Timeout() || ne.Temporary())
+}
+
+// writeDeadline returns the deadline for the next write to a client: the
+// write timeout from now, brought forward to leaveBy (in Unix nanoseconds) if
+// the client is on its way out. Zero means no deadline.
+func writeDeadline(timeout time.Duration, leaveBy int64) time.Time {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if leaveBy != 0 {
+		if quit := time.Unix(0, leaveBy); deadline.IsZero() || quit.Before(deadline) {
+			deadline = quit
+		}
+	}
+	return deadline
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `~`, `\~`, `#`, `\#`,
+	`[`, `\[`, `]`, `\]`, `(`, `\(`, `)`, `\)`, `<`, `\<`, `>`, `\>`,
+	`|`, `\|`, `!`, `\!`,
+)
+
+// escapeMarkdown backslash-escapes characters that markdown renderers would
+// treat as formatting.
+func escapeMarkdown(msg string) string {
+	return markdownEscaper.Replace(msg)
+}
+
+// connError records a failed read or write on a client connection. A client
+// hanging up, or the conn being closed on our side, is not an error.
+func (b *Board) connError(name, addr string, err error) {
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	b.cfg.Events.emit(Event{
+		Type:  EventError,
+		Time:  b.cfg.clock().Now(),
+		Board: b.Name,
+		Name:  name,
+		Addr:  addr,
+		Err:   err,
+	})
+}
+
+// identityPrefix starts the line an auth proxy sends ahead of everything
+// else, naming the user it authenticated.
+const identityPrefix = "IDENTITY "
 
-	// Each board has its own goroutine for serialization of events.
-	go b.HandleBoard()
+// readIdentity reads the user name an auth proxy sent for the connection.
+func readIdentity(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, identityPrefix) {
+		return "", errors.New("missing identity line")
+	}
+	name := strings.TrimSpace(strings.TrimPrefix(line, identityPrefix))
+	if name == "" {
+		return "", errors.New("empty identity")
+	}
+	return name, nil
+}
+
+// refuse sends a final notice to a client that is about to be disconnected.
+// Errors are ignored since the connection is being dropped anyway.
+func refuse(p protocol, msg string) {
+	p.WriteLine(msg)
+	p.Flush()
+}
+
+// refuseRetry is refuse for a rejection that should clear up by itself, such
+// as a lack of capacity. If after is set, a "retry-after <seconds>" line
+// follows msg so that well-behaved clients know how long to back off.
+func refuseRetry(p protocol, msg string, after time.Duration) {
+	p.WriteLine(msg)
+	if after > 0 {
+		secs := int64((after + time.Second - 1) / time.Second)
+		p.WriteLine(fmt.Sprintf("retry-after %d", secs))
+	}
+	p.Flush()
+}
+
+// Single routine to accept all new connections. Only returns if the listener
+// cannot be set up.
+func Run(cfg Config) error {
+	s := NewServer(cfg)
+	defer s.Close()
+	if err := s.Listen(cfg); err != nil {
+		return fmt.Errorf("net.Listen: %s", err)
+	}
+	if err := s.Wait(); err != nil {
+		return fmt.Errorf("net.Accept: %s", err)
+	}
+	return nil
+}
+
+// serveRooms serves every connection on l, landing each in the DefaultRoom
+// once it has logged in. The registry starts a goroutine per board for
+// serialization of events.
+func serveRooms(l net.Listener, cfg Config) error {
+	s := NewServer(cfg)
+	defer s.Close()
+	s.serve(l, cfg)
+	return s.Wait()
+}
 
-	listen, err := net.Listen("tcp", ":5001")
+// Server is a set of rooms and the listener that lets clients in to them.
+// The listener can be replaced, to pick up new listener settings, without
+// touching the rooms or the clients already connected.
+type Server struct {
+	cfg    Config
+	boards *BoardRegistry
+	lobby  *Board
+	// slots counts connections across every listener, so that replacing
+	// one does not let in MaxConnections more.
+	slots chan struct{}
+
+	mu sync.Mutex
+	l  net.Listener
+	// errs is sent the error that stopped the current listener.
+	errs   chan error
+	closed chan struct{}
+}
+
+// NewServer returns a Server for the rooms described by cfg. It does not
+// listen until Listen is called.
+func NewServer(cfg Config) *Server {
+	boards := NewBoardRegistry(cfg)
+	s := &Server{
+		cfg:    cfg,
+		boards: boards,
+		lobby:  boards.GetOrCreate(cfg.defaultRoom()),
+		errs:   make(chan error, 1),
+		closed: make(chan struct{}),
+	}
+	if cfg.MaxConnections > 0 {
+		s.slots = make(chan struct{}, cfg.MaxConnections)
+	}
+	return s
+}
+
+// Listen opens a listener with the listener settings in cfg, such as Addr,
+// ReusePort and Backlog, and starts accepting on it. Any listener from an
+// earlier call is closed once the new one is open; if the new one cannot be
+// opened the old one is kept.
+func (s *Server) Listen(cfg Config) error {
+	l, err := listen(cfg)
 	if err != nil {
-		panic(fmt.Errorf("net.Listen: %s", err))
+		return err
 	}
+	s.serve(l, cfg)
+	return nil
+}
+
+// serve makes l the server's listener and starts accepting on it.
+func (s *Server) serve(l net.Listener, cfg Config) {
+	s.mu.Lock()
+	old := s.l
+	s.l = l
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	go func() {
+		err := serveConns(l, s.lobby, cfg, s.slots)
+		s.mu.Lock()
+		current := s.l == l
+		s.mu.Unlock()
+		// A listener that was replaced or closed on purpose is no
+		// failure.
+		if current {
+			select {
+			case s.errs <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// Addr returns the address of the current listener, or nil if there is
+// none.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.l == nil {
+		return nil
+	}
+	return s.l.Addr()
+}
+
+// Wait blocks until the current listener fails, returning why, or until
+// the server is closed, returning nil.
+func (s *Server) Wait() error {
+	select {
+	case err := <-s.errs:
+		return err
+	case <-s.closed:
+		return nil
+	}
+}
+
+// Close stops listening and closes every room.
+func (s *Server) Close() {
+	s.mu.Lock()
+	l := s.l
+	s.l = nil
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mu.Unlock()
+	if l != nil {
+		l.Close()
+	}
+	s.boards.Close()
+}
+
+// Accept errors that may clear up by themselves, such as running out of file
+// descriptors, are retried after a delay that doubles with every failure in a
+// row, up to maxAcceptDelay.
+const (
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+)
+
+// accept serves every connection on listen, turning away those beyond
+// cfg.MaxConnections. It returns the first error from listen that is not
+// temporary.
+func accept(listen net.Listener, b *Board, cfg Config) error {
+	var slots chan struct{}
+	if cfg.MaxConnections > 0 {
+		slots = make(chan struct{}, cfg.MaxConnections)
+	}
+	return serveConns(listen, b, cfg, slots)
+}
+
+// serveConns is accept with slots, if not nil, holding a token for every
+// connection being served.
+func serveConns(listen net.Listener, b *Board, cfg Config, slots chan struct{}) error {
+	churn := newChurnGuard(cfg)
+	var delay time.Duration
 	for {
 		conn, err := listen.Accept()
 		if err != nil {
-			fmt.Printf("net.Accept: %s\n", err)
+			if !temporary(err) {
+				return err
+			}
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else if delay *= 2; delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			fmt.Printf("net.Accept: %s, retrying in %s\n", err, delay)
+			<-cfg.clock().After(delay)
 			continue
 		}
-		go Serve(b, conn)
+		delay = 0
+		if err := keepAlive(conn, cfg.KeepAlive); err != nil {
+			fmt.Printf("keepalive %s: %s\n", conn.RemoteAddr(), err)
+		}
+		if churn != nil {
+			src := source(conn.RemoteAddr())
+			if ok, wait := churn.allow(src, cfg.clock().Now()); !ok {
+				go func() {
+					defer conn.Close()
+					p := &lineProtocol{reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+					refuseRetry(p, "reconnecting too often", wait)
+				}()
+				continue
+			}
+		}
+		if slots != nil && !takeSlot(slots, cfg) {
+			go func() {
+				defer conn.Close()
+				p := &lineProtocol{reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+				refuseRetry(p, "server is full", cfg.RetryAfter)
+			}()
+			continue
+		}
+		go func() {
+			if slots != nil {
+				defer func() { <-slots }()
+			}
+			Serve(b, conn)
+		}()
+	}
+}
+
+// takeSlot claims a connection slot, waiting up to cfg.ConnectionWait for
+// one to come free. Nothing more is accepted meanwhile, so further
+// connections queue up in the listener's backlog rather than costing a
+// goroutine each.
+func takeSlot(slots chan struct{}, cfg Config) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if cfg.ConnectionWait <= 0 {
+		return false
+	}
+	t := cfg.clock().NewTimer(cfg.ConnectionWait)
+	defer t.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-t.C():
+		return false
 	}
 }
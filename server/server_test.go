@@ -0,0 +1,1637 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCountChange(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	counts := make(chan int, 10)
+	b.OnCountChange(func(n int) { counts <- n })
+
+	reply := make(chan *Notification, 10)
+	b.Login("alice", reply)
+	b.Login("bob", reply)
+	b.Login("bob", reply) // collision, no change
+	b.Logout("alice")
+	b.Logout("bob")
+	b.sync()
+	close(counts)
+	var got []int
+	for n := range counts {
+		got = append(got, n)
+	}
+	if want := []int{1, 2, 1, 0}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("counts = %v, want %v", got, want)
+	}
+}
+
+func TestCountChangeConfig(t *testing.T) {
+	type count struct {
+		board string
+		n     int
+	}
+	counts := make(chan count, 10)
+	cfg := DefaultConfig()
+	cfg.OnCountChange = func(board string, n int) { counts <- count{board, n} }
+	boards := NewBoardRegistry(cfg)
+
+	reply := make(chan *Notification, 10)
+	boards.GetOrCreate("a").Login("alice", reply)
+	boards.GetOrCreate("b").Login("alice", reply)
+	boards.GetOrCreate("a").Logout("alice")
+	for _, want := range []count{{"a", 1}, {"b", 1}, {"a", 0}} {
+		if got := <-counts; got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestAck(t *testing.T) {
+	for _, mode := range []AckMode{AckQueued, AckDelivered} {
+		cfg := DefaultConfig()
+		cfg.Ack = mode
+		b := startBoard(cfg)
+		reply := make(chan *Notification, 10)
+		b.Login("bob", reply)
+
+		acks := make(chan *Notification, 10)
+		b.PublishAck("alice", "one", acks)
+		b.PublishAck("alice", "two", acks)
+		for _, seq := range []uint64{1, 2} {
+			if n := recv(t, acks); n.Type != ACK || n.Seq != seq || n.Name != "alice" {
+				t.Errorf("mode %d: got %+v, want ack %d", mode, n, seq)
+			}
+		}
+		if n := recv(t, reply); n.Msg != "one" {
+			t.Errorf("mode %d: bob got %+v", mode, n)
+		}
+	}
+}
+
+func TestAckDeliveredWithheldOnDrop(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Ack = AckDelivered
+	cfg.SendQueueSize = 1
+	b := startBoard(cfg)
+	full := make(chan *Notification, 1)
+	b.Login("bob", full)
+	b.Publish("carol", "fills bob's queue")
+
+	acks := make(chan *Notification, 10)
+	b.PublishAck("alice", "dropped for bob", acks)
+	b.sync()
+	empty(t, acks)
+
+	recv(t, full)
+	b.PublishAck("alice", "reaches bob", acks)
+	if n := recv(t, acks); n.Seq != 3 {
+		t.Errorf("got %+v, want ack 3", n)
+	}
+}
+
+func TestAckNotDropped(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Ack = AckQueued
+	cfg.SendQueueSize = 1
+	b := startBoard(cfg)
+	reply := make(chan *Notification, 1)
+	b.Login("alice", reply)
+	b.Publish("bob", "fills alice's queue")
+	b.sync()
+
+	// The board does not wait for room for the ACK.
+	b.PublishAck("alice", "hi", reply)
+	b.sync()
+	if n := recv(t, reply); n.Msg != "fills alice's queue" {
+		t.Fatalf("got %+v", n)
+	}
+	empty(t, reply)
+	b.PublishAck("alice", "again", reply)
+	if n := recv(t, reply); n.Type != ACK || n.Seq != 3 {
+		t.Errorf("got %+v, want ack 3", n)
+	}
+
+	// Nor for a publisher that is not on the board.
+	stuck := make(chan *Notification)
+	b.PublishAck("carol", "hello", stuck)
+	b.sync()
+	if n := recv(t, reply); n.Msg != "hello" {
+		t.Errorf("got %+v", n)
+	}
+}
+
+func TestBannedWords(t *testing.T) {
+	for _, tc := range []struct {
+		wholeWord bool
+		msg, want string
+	}{
+		{false, "Darn it", "**** it"},
+		{false, "a classy heck", "a cl***y ****"},
+		{true, "a classy heck", "a classy ****"},
+		{true, "ass, Ass!", "***, ***!"},
+	} {
+		cfg := DefaultConfig()
+		cfg.BannedWords = []string{"darn", "ass", "heck", ""}
+		cfg.BannedWordsWholeWord = tc.wholeWord
+		b := startBoard(cfg)
+		reply := make(chan *Notification, 1)
+		b.Login("bob", reply)
+		b.Publish("alice", tc.msg)
+		if n := recv(t, reply); n.Msg != tc.want {
+			t.Errorf("wholeWord=%v: %q masked to %q, want %q", tc.wholeWord, tc.msg, n.Msg, tc.want)
+		}
+	}
+}
+
+func TestLoginRace(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			errs <- b.Login("alice", make(chan *Notification, 10))
+		}()
+	}
+	var ok, taken int
+	for i := 0; i < n; i++ {
+		switch err := <-errs; err {
+		case nil:
+			ok++
+		case ErrNameTaken:
+			taken++
+		default:
+			t.Fatal(err)
+		}
+	}
+	if ok != 1 || taken != n-1 {
+		t.Errorf("%d logins succeeded and %d collided", ok, taken)
+	}
+}
+
+func TestLoginTakenReprompts(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	dial(t, b, "alice")
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("alice")
+	c.expect(ErrNameTaken.Error(), "username> ")
+	c.send("bob")
+	c.quiet()
+}
+
+func TestWatermarks(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.SendQueueSize = 4
+	cfg.HighWatermark = 3
+	cfg.LowWatermark = 1
+	b := startBoard(cfg)
+	reply := make(chan *Notification, cfg.SendQueueSize)
+	b.Login("bob", reply)
+	congested := func() bool {
+		var c bool
+		b.query(func() { c = b.clients["bob"].congested })
+		return c
+	}
+
+	b.Publish("alice", "1")
+	b.Publish("alice", "2")
+	if congested() {
+		t.Fatal("congested below the high watermark")
+	}
+	b.Publish("alice", "3")
+	if !congested() {
+		t.Fatal("not congested at the high watermark")
+	}
+	recv(t, reply)
+	recv(t, reply)
+	b.Publish("alice", "4")
+	if !congested() {
+		t.Fatal("cleared above the low watermark")
+	}
+	recv(t, reply)
+	recv(t, reply)
+	b.Publish("alice", "5")
+	if congested() {
+		t.Fatal("still congested at the low watermark")
+	}
+}
+
+func TestForEachClient(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	for _, name := range []string{"carol", "alice", "bob"} {
+		b.Login(name, make(chan *Notification, 10))
+	}
+	b.Logout("bob")
+	var got []string
+	b.ForEachClient(func(name string) {
+		got = append(got, name)
+	})
+	if want := []string{"alice", "carol"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("visited %q, want %q", got, want)
+	}
+}
+
+func TestSystemMessagesToStalledClient(t *testing.T) {
+	for _, role := range []Role{RoleRegular, RoleSpectator} {
+		cfg := DefaultConfig()
+		cfg.SendQueueSize = 1
+		b := startBoard(cfg)
+		alice := make(chan *Notification, 10)
+		b.Login("alice", alice)
+		// bob never reads.
+		b.Login("bob", make(chan *Notification, cfg.SendQueueSize))
+		if err := b.SetRole("alice", "bob", role); err != nil {
+			t.Fatal(err)
+		}
+		b.Publish("alice", "fills the queue")
+
+		done := make(chan struct{})
+		go func() {
+			b.SetTopic("alice", "still going")
+			b.Announce("and going")
+			b.sync()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Fatalf("%v: board held up by a client that does not read", role)
+		}
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	stalled := func(t *testing.T, overflow OverflowPolicy) (*Board, chan *Notification) {
+		cfg := DefaultConfig()
+		cfg.SendQueueSize = 2
+		cfg.Overflow = overflow
+		b := startBoard(cfg)
+		reply := make(chan *Notification, cfg.SendQueueSize)
+		b.Login("bob", reply)
+		for i := 1; i <= 10; i++ {
+			b.Publish("alice", strconv.Itoa(i))
+		}
+		b.sync()
+		return b, reply
+	}
+
+	t.Run("drop newest", func(t *testing.T) {
+		b, reply := stalled(t, DropNewest)
+		for _, want := range []string{"1", "2"} {
+			if n := recv(t, reply); n.Msg != want {
+				t.Fatalf("got %q, want %q", n.Msg, want)
+			}
+		}
+		b.sync()
+		empty(t, reply)
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		_, reply := stalled(t, DropOldest)
+		// bob is given a queue of their own that feeds reply as fast as
+		// it can, so how much gets through before the drops start
+		// varies. It always ends with the latest.
+		var got []string
+		for len(got) == 0 || got[len(got)-1] != "10" {
+			got = append(got, recv(t, reply).Msg)
+		}
+		if len(got) == 10 || got[len(got)-2] != "9" {
+			t.Fatalf("got %q, want the latest with some dropped before them", got)
+		}
+	})
+
+	t.Run("disconnect slow", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.SendQueueSize = 2
+		cfg.Overflow = DisconnectSlow
+		b := startBoard(cfg)
+		// carol is in-process, with no connection to hang up.
+		carol := make(chan *Notification, cfg.SendQueueSize)
+		b.Login("carol", carol)
+		srv, cli := net.Pipe()
+		defer cli.Close()
+		go Serve(b, srv)
+		r := bufio.NewReader(cli)
+		if line, err := r.ReadString(' '); err != nil || line != "username> " {
+			t.Fatalf("got %q, %v", line, err)
+		}
+		io.WriteString(cli, "bob\n/topic\n")
+		if line, err := r.ReadString('\n'); err != nil || line != "* no topic is set\n" {
+			t.Fatalf("got %q, %v", line, err)
+		}
+
+		// bob stops reading.
+		for i := 1; i <= 10; i++ {
+			b.Publish("alice", strconv.Itoa(i))
+		}
+		b.sync()
+		cli.SetReadDeadline(time.Now().Add(testTimeout))
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			t.Fatalf("bob was not disconnected: %v", err)
+		}
+		if n := recv(t, carol); n.Msg != "1" {
+			t.Fatalf("carol got %q, want %q", n.Msg, "1")
+		}
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.IdleTimeout = time.Minute
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+
+	clock.Advance(time.Minute)
+	c.expect("* disconnected for being idle")
+	c.closed()
+}
+
+func TestIdleCheckInterval(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// active is when the client last sends a line, in checks.
+		active int
+		// want is the check that disconnects the client.
+		want int
+	}{
+		{"quiet", 0, 4},
+		{"active", 1, 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := newFakeClock()
+			clock.started = make(chan time.Duration, 100)
+			cfg := DefaultConfig()
+			cfg.Clock = clock
+			cfg.IdleTimeout = 10 * time.Second
+			cfg.IdleCheckInterval = 3 * time.Second
+			b := startBoard(cfg)
+			c := dial(t, b, "alice")
+			// checked waits for the session to arm its idle check, which
+			// it does after every check that leaves the client connected.
+			checked := func() {
+				t.Helper()
+				for {
+					select {
+					case d := <-clock.started:
+						if d == cfg.IdleCheckInterval {
+							return
+						}
+					case <-time.After(testTimeout):
+						t.Fatal("timed out waiting for the idle check")
+					}
+				}
+			}
+			checked()
+			for i := 1; i < tc.want; i++ {
+				clock.Advance(cfg.IdleCheckInterval)
+				checked()
+				if i == tc.active {
+					c.sync()
+				}
+			}
+			clock.Advance(cfg.IdleCheckInterval)
+			c.expect("* disconnected for being idle")
+			c.closed()
+		})
+	}
+}
+
+func TestFragment(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FragmentSize = 4
+	b := startBoard(cfg)
+	for _, tc := range []struct {
+		msg  string
+		want []string
+	}{
+		{"abcd", []string{"abcd"}},
+		{"abcdefghij", []string{"abcd", "efgh", "ij"}},
+		// é is two bytes and is not split.
+		{"abcéfg", []string{"abc", "éfg"}},
+	} {
+		frags := b.fragment(&Notification{Type: TEXTLINE, Name: "a", Msg: tc.msg, Seq: 7})
+		if len(frags) != len(tc.want) {
+			t.Errorf("%q split into %d parts, want %d", tc.msg, len(frags), len(tc.want))
+			continue
+		}
+		for i, f := range frags {
+			parts := len(tc.want)
+			if parts == 1 {
+				parts = 0
+			}
+			if f.Msg != tc.want[i] || f.Seq != 7 || f.Parts != parts || (parts > 0 && f.Part != i+1) {
+				t.Errorf("%q part %d = %+v, want %q", tc.msg, i, f, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestFragmentServe(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FragmentSize = 5
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	alice.send("hello world")
+	bob.expect("alice [1/3]: hello", "alice [2/3]:  worl", "alice [3/3]: d")
+}
+
+func TestQuitFlushes(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	c := dial(t, b, "bob")
+	b.Publish("alice", "one")
+	b.Publish("alice", "two")
+	c.send("/quit")
+	c.expect("alice: one", "alice: two", "* goodbye")
+	c.closed()
+	if _, _, online, _ := b.Seen("bob"); online {
+		t.Error("bob is still logged in")
+	}
+}
+
+func TestAnonymousLogin(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	if _, err := b.LoginAnonymous(make(chan *Notification, 10)); err != ErrNameRequired {
+		t.Fatalf("got %v, want ErrNameRequired", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.AllowAnonymous = true
+	b = startBoard(cfg)
+	b.Login("guest-2", make(chan *Notification, 10))
+	for _, want := range []string{"guest-1", "guest-3"} {
+		name, err := b.LoginAnonymous(make(chan *Notification, 10))
+		if err != nil || name != want {
+			t.Errorf("got %q, %v, want %q", name, err, want)
+		}
+	}
+
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("")
+	c.expect("* you are guest-4")
+
+	// Nicknames are names in use too.
+	if err := b.SetNick("guest-2", "guest-5"); err != nil {
+		t.Fatal(err)
+	}
+	if name, err := b.LoginAnonymous(make(chan *Notification, 10)); err != nil || name != "guest-6" {
+		t.Errorf("got %q, %v, want guest-6", name, err)
+	}
+}
+
+func TestMaxNameLength(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxNameLength = 5
+	b := startBoard(cfg)
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("alexander")
+	c.expect("name is too long", "username> ")
+	c.send("alex")
+	c.quiet()
+
+	// With TruncateNames the name is cut instead, and numbered if the cut
+	// name is taken.
+	cfg.TruncateNames = true
+	b = startBoard(cfg)
+	for _, want := range []string{"alexa", "ale-2", "ale-3"} {
+		c := connect(t, b)
+		c.expect("username> ")
+		c.send("alexander")
+		c.expect("* you are " + want)
+	}
+	c = connect(t, b)
+	c.expect("username> ")
+	c.send("zoë")
+	c.quiet()
+	if s := b.Stats(); !reflect.DeepEqual(s.Members, []string{"ale-2", "ale-3", "alexa", "zoë"}) {
+		t.Errorf("members are %v", s.Members)
+	}
+}
+
+func TestNameGenerator(t *testing.T) {
+	animals := []string{"BlueFox", "RedOwl"}
+	cfg := DefaultConfig()
+	cfg.AllowAnonymous = true
+	cfg.Names = NameFunc(func(n int) string { return animals[(n-1)%len(animals)] })
+	b := startBoard(cfg)
+	b.Login("BlueFox", make(chan *Notification, 10))
+	name, err := b.LoginAnonymous(make(chan *Notification, 10))
+	if err != nil || name != "RedOwl" {
+		t.Errorf("got %q, %v, want RedOwl", name, err)
+	}
+	// With every name taken the board falls back to numbered names.
+	name, err = b.LoginAnonymous(make(chan *Notification, 10))
+	if err != nil || !strings.HasPrefix(name, "guest-") {
+		t.Errorf("got %q, %v, want a guest name", name, err)
+	}
+
+	cfg.Names = NumberedNames("Anon")
+	b = startBoard(cfg)
+	b.Login("Anon1", make(chan *Notification, 10))
+	if name, _ := b.LoginAnonymous(make(chan *Notification, 10)); name != "Anon2" {
+		t.Errorf("got %q, want Anon2", name)
+	}
+}
+
+func TestMaxSessionDuration(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.MaxSessionDuration = time.Hour
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+
+	clock.Advance(time.Hour)
+	c.expect("* session expired, please reconnect")
+	c.closed()
+}
+
+func TestReauthOnExpiry(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.MaxSessionDuration = time.Hour
+	cfg.ReauthOnExpiry = true
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+
+	clock.Advance(time.Hour)
+	c.expect("* session expired, please log in again", "username> ")
+	if _, _, online, _ := b.Seen("alice"); online {
+		t.Fatal("alice is still logged in")
+	}
+	c.send("alice")
+	c.quiet()
+	b.Publish("bob", "hi")
+	c.expect("bob: hi")
+
+	// The new session has its own deadline.
+	clock.Advance(time.Hour)
+	c.expect("* session expired, please log in again", "username> ")
+}
+
+func TestEscapeMarkdown(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EscapeMarkdown = true
+	b := startBoard(cfg)
+	c := dial(t, b, "alice")
+	b.Publish("bob", "*bold* [link](x) `code`")
+	c.expect(`bob: \*bold\* \[link\]\(x\) \` + "`code\\`")
+	// Notices are the server's own text and are left alone.
+	c.send("/topic *important*")
+	c.expect("* alice set the topic: *important*")
+}
+
+func TestRoomFullRetryAfter(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxClients = 1
+	cfg.RetryAfter = 1500 * time.Millisecond
+	b := startBoard(cfg)
+	dial(t, b, "alice")
+	c := connect(t, b)
+	c.expect("username> ")
+	c.send("bob")
+	c.expect(ErrRoomFull.Error(), "retry-after 2")
+	c.closed()
+}
+
+func TestPresenceNotices(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PresenceNotices = true
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	alice.expect("* bob joined")
+	bob.send("/quit")
+	bob.expect("* goodbye")
+	alice.expect("* bob left")
+}
+
+func TestCoalescedPresence(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.PresenceNotices = true
+	cfg.CoalesceWindow = time.Second
+	b := startBoard(cfg)
+	alice := make(chan *Notification, 10)
+	bob := make(chan *Notification, 10)
+	b.Login("alice", alice)
+	b.Login("bob", bob)
+	b.Login("carol", make(chan *Notification, 10))
+	b.Logout("carol")
+	b.sync()
+	empty(t, alice)
+	clock.Advance(time.Second)
+	// Joiners are not told about themselves.
+	for _, want := range []string{"bob, carol joined", "carol left"} {
+		if n := recv(t, alice); n.Msg != want {
+			t.Errorf("alice got %q, want %q", n.Msg, want)
+		}
+	}
+	for _, want := range []string{"alice, carol joined", "carol left"} {
+		if n := recv(t, bob); n.Msg != want {
+			t.Errorf("bob got %q, want %q", n.Msg, want)
+		}
+	}
+	empty(t, bob)
+}
+
+func TestLeaveGrace(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.PresenceNotices = true
+	cfg.LeaveGrace = 10 * time.Second
+	b := startBoard(cfg)
+	alice := make(chan *Notification, 10)
+	b.Login("alice", alice)
+	b.Login("bob", make(chan *Notification, 10))
+	b.Login("carol", make(chan *Notification, 10))
+	recv(t, alice)
+	recv(t, alice)
+
+	// A quick reconnect is not announced at all.
+	b.Logout("bob")
+	clock.Advance(5 * time.Second)
+	b.Login("bob", make(chan *Notification, 10))
+	b.sync()
+	empty(t, alice)
+
+	// A leave is announced once the grace is up, each in its own time.
+	b.Logout("bob")
+	clock.Advance(5 * time.Second)
+	b.Logout("carol")
+	clock.Advance(5 * time.Second)
+	if n := recv(t, alice); n.Msg != "bob left" {
+		t.Errorf("got %q, want bob left", n.Msg)
+	}
+	b.sync()
+	empty(t, alice)
+	clock.Advance(5 * time.Second)
+	if n := recv(t, alice); n.Msg != "carol left" {
+		t.Errorf("got %q, want carol left", n.Msg)
+	}
+	// Coming back after that is a join like any other.
+	b.Login("bob", make(chan *Notification, 10))
+	if n := recv(t, alice); n.Msg != "bob joined" {
+		t.Errorf("got %q, want bob joined", n.Msg)
+	}
+}
+
+func TestMentions(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MentionPings = true
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	carol := dial(t, b, "carol")
+
+	alice.send("@bob, @dave and @alice: lunch?")
+	bob.expect("! alice: @bob, @dave and @alice: lunch?", "* alice mentioned you")
+	carol.expect("alice: @bob, @dave and @alice: lunch?")
+	carol.quiet()
+	// Authors are not pinged by their own message.
+	alice.quiet()
+
+	alice.send("email bob@example.com")
+	bob.expect("alice: email bob@example.com")
+	bob.quiet()
+}
+
+func TestEchoToSender(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.EchoToSender = true
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	alice.send("hi")
+	alice.expect("you: hi")
+	bob.expect("alice: hi")
+	bob.send("hello")
+	alice.expect("bob: hello")
+	bob.expect("you: hello")
+}
+
+func TestSpectatorsYield(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	admin := make(chan *Notification)
+	b.Login("alice", admin)
+	b.Login("bob", make(chan *Notification, 100))
+	// Nobody ever reads this spectator's messages.
+	b.Login("sam", make(chan *Notification))
+	if err := b.SetRole("bob", "sam", RoleSpectator); err != ErrNotAdmin {
+		t.Errorf("non-admin set a role: %v", err)
+	}
+	if err := b.SetRole("alice", "sam", RoleSpectator); err != nil {
+		t.Fatal(err)
+	}
+	const flood = 50
+	go func() {
+		for i := 0; i < flood; i++ {
+			b.Publish("bob", fmt.Sprint(i))
+		}
+	}()
+	for i := 0; i < flood; i++ {
+		if n := recv(t, admin); n.Msg != fmt.Sprint(i) {
+			t.Fatalf("got %q, want %d", n.Msg, i)
+		}
+	}
+
+	var r Role
+	b.query(func() { r = b.roleOf("alice", b.clients["alice"]) })
+	if r != RoleAdmin {
+		t.Errorf("admin has role %s", r)
+	}
+	if err := b.SetRole("alice", "sam", RoleAdmin); err == nil {
+		t.Error("made a second admin")
+	}
+}
+
+func TestWriteDeadline(t *testing.T) {
+	if d := writeDeadline(0, 0); !d.IsZero() {
+		t.Errorf("no timeout gave deadline %v", d)
+	}
+	quit := time.Now().Add(time.Second)
+	if d := writeDeadline(0, quit.UnixNano()); !d.Equal(quit) {
+		t.Errorf("got %v, want the quit deadline %v", d, quit)
+	}
+	if d := writeDeadline(time.Hour, quit.UnixNano()); !d.Equal(quit) {
+		t.Errorf("got %v, want the earlier quit deadline %v", d, quit)
+	}
+	if d := writeDeadline(time.Millisecond, quit.UnixNano()); !d.Before(quit) {
+		t.Errorf("got %v, want the earlier write timeout", d)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WriteTimeout = 10 * time.Millisecond
+	cfg.Events = NewEventStream(10, false)
+	b := startBoard(cfg)
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go Serve(b, srv)
+	prompt := make([]byte, len("username> "))
+	if _, err := io.ReadFull(cli, prompt); err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("alice\n"))
+
+	// alice never reads what she is sent.
+	for {
+		select {
+		case e := <-cfg.Events.C:
+			if e.Type == EventLogin {
+				b.Publish("bob", "hello?")
+			}
+			if e.Type != EventError {
+				continue
+			}
+			if !errors.Is(e.Err, os.ErrDeadlineExceeded) {
+				t.Errorf("got error %v, want a deadline", e.Err)
+			}
+			return
+		case <-time.After(testTimeout):
+			t.Fatal("slow client was not dropped")
+		}
+	}
+}
+
+// flakyWriter fails its first write with err, having written nothing.
+type flakyWriter struct {
+	err    error
+	failed bool
+	buf    []byte
+}
+
+func (w *flakyWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		w.failed = true
+		return 0, w.err
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func TestRetryWriter(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		retry bool
+	}{
+		{io.ErrShortWrite, true},
+		{&net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EINTR)}, true},
+		{fmt.Errorf("wrapped: %w", syscall.EAGAIN), true},
+		{os.ErrDeadlineExceeded, false},
+		{syscall.EPIPE, false},
+	} {
+		w := &flakyWriter{err: tc.err}
+		n, err := (&retryWriter{w: w}).Write([]byte("hi"))
+		if tc.retry && (n != 2 || err != nil || string(w.buf) != "hi") {
+			t.Errorf("%v: got %d, %v, want a retried write", tc.err, n, err)
+		}
+		if !tc.retry && err != tc.err {
+			t.Errorf("%v: got %d, %v, want the error back", tc.err, n, err)
+		}
+	}
+}
+
+// chunkConn writes at most three bytes at a time, reporting a short write
+// for anything longer.
+type chunkConn struct {
+	net.Conn
+}
+
+func (c chunkConn) Write(p []byte) (int, error) {
+	if len(p) <= 3 {
+		return c.Conn.Write(p)
+	}
+	n, err := c.Conn.Write(p[:3])
+	if err == nil {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// stuckWriter never writes anything.
+type stuckWriter struct {
+	writes int
+}
+
+func (w *stuckWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return 0, syscall.EAGAIN
+}
+
+func TestLoginAndMessageTogether(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   func(*Config)
+		write string
+	}{
+		{"plain", func(*Config) {}, "alice\nhello\n"},
+		{"compression offered", func(cfg *Config) { cfg.Compression = true }, "alice\nhello\n"},
+		{"caps", func(*Config) {}, "CAPS welcome\nalice\nhello\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tc.cfg(&cfg)
+			b := startBoard(cfg)
+			bob := make(chan *Notification, 10)
+			b.Login("bob", bob)
+			c := connect(t, b)
+			c.expect("username> ")
+			// Both lines in one write, so that the server reads them
+			// into its buffer together.
+			if _, err := c.conn.Write([]byte(tc.write)); err != nil {
+				t.Fatal(err)
+			}
+			if n := recv(t, bob); n.Name != "alice" || n.Msg != "hello" {
+				t.Errorf("bob got %+v", n)
+			}
+		})
+	}
+}
+
+func TestPartialWrites(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	go Serve(b, chunkConn{srv})
+	c := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+	go c.read()
+	c.expect("username> ")
+	c.send("alice")
+	c.sync()
+	msg := strings.Repeat("all of this arrives ", 20)
+	b.Publish("bob", msg)
+	c.expect("bob: " + msg)
+
+	w := &stuckWriter{}
+	if n, err := (&retryWriter{w: w}).Write([]byte("hi")); n != 0 || err != syscall.EAGAIN {
+		t.Errorf("got %d, %v, want EAGAIN", n, err)
+	}
+	if w.writes != maxWriteStalls {
+		t.Errorf("gave up after %d writes, want %d", w.writes, maxWriteStalls)
+	}
+}
+
+func TestWaitQueue(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxClients = 1
+	cfg.WaitQueueSize = 2
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+
+	bob := connect(t, b)
+	bob.expect("username> ")
+	bob.send("bob")
+	bob.expect("* room is full, you are number 1 in line")
+	carol := connect(t, b)
+	carol.expect("username> ")
+	carol.send("carol")
+	carol.expect("* room is full, you are number 2 in line")
+	// The line is full too.
+	dave := connect(t, b)
+	dave.expect("username> ")
+	dave.send("dave")
+	dave.expect(ErrRoomFull.Error(), "retry-after 30")
+
+	alice.send("/quit")
+	alice.expect("* goodbye")
+	carol.expect("* room is full, you are number 1 in line")
+	bob.quiet()
+	b.Publish("zed", "hi")
+	bob.expect("zed: hi")
+
+	bob.send("/quit")
+	bob.expect("* goodbye")
+	carol.quiet()
+}
+
+func TestWaitQueueLogin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxClients = 1
+	cfg.WaitQueueSize = 1
+	b := startBoard(cfg)
+	b.Login("alice", make(chan *Notification, 10))
+	queued := make(chan int, 1)
+	done := make(chan error)
+	go func() {
+		_, err := b.login("bob", nil, make(chan *Notification, 10), func(pos int) { queued <- pos })
+		done <- err
+	}()
+	if pos := <-queued; pos != 1 {
+		t.Fatalf("bob is number %d in line", pos)
+	}
+	// Waiting names are taken.
+	if err := b.Login("bob", make(chan *Notification, 10)); err != ErrNameTaken {
+		t.Errorf("got %v, want ErrNameTaken for a waiting name", err)
+	}
+	b.Logout("alice")
+	if err := <-done; err != nil {
+		t.Errorf("queued login failed: %v", err)
+	}
+}
+
+func TestMessageLengthLimits(t *testing.T) {
+	msg := "你好世界" // 4 runes, 12 bytes
+	for _, tc := range []struct {
+		bytes, runes int
+		refused      string
+	}{
+		{0, 4, ""},
+		{12, 0, ""},
+		{11, 0, "message too long, the limit is 11 bytes"},
+		{0, 3, "message too long, the limit is 3 characters"},
+		{12, 3, "message too long, the limit is 3 characters"},
+	} {
+		cfg := DefaultConfig()
+		cfg.MaxMessageBytes = tc.bytes
+		cfg.MaxMessageRunes = tc.runes
+		b := startBoard(cfg)
+		alice := make(chan *Notification, 10)
+		bob := make(chan *Notification, 10)
+		b.Login("alice", alice)
+		b.Login("bob", bob)
+		b.Publish("alice", msg)
+		b.sync()
+		if tc.refused == "" {
+			if n := recv(t, bob); n.Msg != msg {
+				t.Errorf("%+v: bob got %+v", tc, n)
+			}
+			continue
+		}
+		empty(t, bob)
+		if n := recv(t, alice); n.Type != NOTICE || n.Msg != tc.refused {
+			t.Errorf("%+v: alice got %+v", tc, n)
+		}
+	}
+}
+
+func TestBlankMessages(t *testing.T) {
+	for _, notify := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.NotifyBlank = notify
+		b := startBoard(cfg)
+		alice := make(chan *Notification, 10)
+		bob := make(chan *Notification, 10)
+		b.Login("alice", alice)
+		b.Login("bob", bob)
+		for _, msg := range []string{"", "   ", "\t"} {
+			b.Publish("alice", msg)
+		}
+		b.Publish("alice", "  hi")
+		b.sync()
+		if n := recv(t, bob); n.Msg != "  hi" {
+			t.Errorf("bob got %+v, want the message with content", n)
+		}
+		empty(t, bob)
+		if notify {
+			for i := 0; i < 3; i++ {
+				if n := recv(t, alice); n.Type != NOTICE || n.Msg != "blank message not sent" {
+					t.Errorf("alice got %+v", n)
+				}
+			}
+		}
+		empty(t, alice)
+	}
+}
+
+// scriptedListener hands out whatever is sent on next, one per Accept.
+type scriptedListener struct {
+	next chan interface{}
+}
+
+type tempError struct{}
+
+func (tempError) Error() string   { return "too many open files" }
+func (tempError) Timeout() bool   { return false }
+func (tempError) Temporary() bool { return true }
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	switch v := (<-l.next).(type) {
+	case net.Conn:
+		return v, nil
+	case error:
+		return nil, v
+	}
+	panic("bad script")
+}
+
+func (l *scriptedListener) Close() error   { return nil }
+func (l *scriptedListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestAcceptBackoff(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration)
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	l := &scriptedListener{next: make(chan interface{})}
+	done := make(chan error, 1)
+	go func() { done <- accept(l, b, cfg) }()
+
+	wait := func(want time.Duration) {
+		t.Helper()
+		l.next <- tempError{}
+		if d := <-clock.started; d != want {
+			t.Fatalf("backed off %s, want %s", d, want)
+		}
+		// Nothing is accepted until the delay is up.
+		select {
+		case l.next <- tempError{}:
+			t.Fatal("accepted again without waiting")
+		default:
+		}
+		clock.Advance(want)
+	}
+	for _, d := range []time.Duration{5, 10, 20, 40, 80, 160, 320, 640, 1000, 1000} {
+		wait(d * time.Millisecond)
+	}
+	// A success starts the delay over.
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	l.next <- srv
+	wait(5 * time.Millisecond)
+
+	permanent := errors.New("listener closed")
+	l.next <- permanent
+	if err := <-done; err != permanent {
+		t.Errorf("accept returned %v", err)
+	}
+}
+
+func TestAcceptMaxConnections(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxConnections = 1
+	cfg.RetryAfter = 30 * time.Second
+	b := startBoard(cfg)
+	l := &scriptedListener{next: make(chan interface{})}
+	go accept(l, b, cfg)
+
+	srv, cli := net.Pipe()
+	first := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+	go first.read()
+	defer cli.Close()
+	l.next <- srv
+	first.expect("username> ")
+
+	srv, cli = net.Pipe()
+	second := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+	go second.read()
+	defer cli.Close()
+	l.next <- srv
+	second.expect("server is full", "retry-after 30")
+	second.closed()
+}
+
+func TestAcceptConnectionWait(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration, 1)
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.MaxConnections = 1
+	cfg.ConnectionWait = time.Minute
+	b := startBoard(cfg)
+	l := &scriptedListener{next: make(chan interface{})}
+	go accept(l, b, cfg)
+	pipe := func() (net.Conn, *testClient) {
+		srv, cli := net.Pipe()
+		c := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+		go c.read()
+		t.Cleanup(func() { cli.Close() })
+		return srv, c
+	}
+
+	srv, first := pipe()
+	l.next <- srv
+	first.expect("username> ")
+	srv, second := pipe()
+	l.next <- srv
+	<-clock.started
+	// Nothing else is accepted while the second waits for a slot.
+	select {
+	case l.next <- tempError{}:
+		t.Fatal("accepted while waiting for a slot")
+	default:
+	}
+	first.conn.Close()
+	second.expect("username> ")
+
+	// A connection that finds no slot in time is turned away.
+	srv, third := pipe()
+	l.next <- srv
+	<-clock.started
+	clock.Advance(time.Minute)
+	third.expect("server is full", "retry-after 30")
+	third.closed()
+}
+
+// addrConn is a net.Conn from a given address.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func TestReconnectCooldown(t *testing.T) {
+	clock := newFakeClock()
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.ReconnectLimit = 2
+	cfg.ReconnectWindow = time.Minute
+	cfg.ReconnectCooldown = 5 * time.Minute
+	b := startBoard(cfg)
+	l := &scriptedListener{next: make(chan interface{})}
+	go accept(l, b, cfg)
+	from := func(ip string) *testClient {
+		srv, cli := net.Pipe()
+		c := &testClient{t: t, conn: cli, lines: make(chan string, 100)}
+		go c.read()
+		t.Cleanup(func() { cli.Close() })
+		l.next <- addrConn{srv, &net.TCPAddr{IP: net.ParseIP(ip), Port: 4000}}
+		return c
+	}
+
+	for i := 0; i < 2; i++ {
+		c := from("10.0.0.1")
+		c.expect("username> ")
+		c.conn.Close()
+	}
+	c := from("10.0.0.1")
+	c.expect("reconnecting too often", "retry-after 300")
+	c.closed()
+	// Other sources are not held up.
+	from("10.0.0.2").expect("username> ")
+	clock.Advance(4 * time.Minute)
+	c = from("10.0.0.1")
+	c.expect("reconnecting too often", "retry-after 60")
+	c.closed()
+
+	clock.Advance(time.Minute)
+	from("10.0.0.1").expect("username> ")
+}
+
+func BenchmarkConnectionChurn(bb *testing.B) {
+	for _, limit := range []int{0, 16} {
+		bb.Run(fmt.Sprintf("max-%d", limit), func(bb *testing.B) {
+			cfg := DefaultConfig()
+			cfg.MaxConnections = limit
+			cfg.ConnectionWait = time.Minute
+			b := startBoard(cfg)
+			defer b.Close()
+			l := &scriptedListener{next: make(chan interface{})}
+			go accept(l, b, cfg)
+			prompt := make([]byte, len("username> "))
+			bb.ResetTimer()
+			bb.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					srv, cli := net.Pipe()
+					l.next <- srv
+					io.ReadFull(cli, prompt)
+					cli.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestDeliveryWorkersOrder(t *testing.T) {
+	const publishers, each = 4, 100
+	cfg := DefaultConfig()
+	cfg.DeliveryWorkers = true
+	b := startBoard(cfg)
+	var receivers []chan *Notification
+	for i := 0; i < 3; i++ {
+		ch := make(chan *Notification)
+		b.Login(fmt.Sprintf("r%d", i), ch)
+		receivers = append(receivers, ch)
+	}
+	for p := 0; p < publishers; p++ {
+		go func(p int) {
+			for i := 0; i < each; i++ {
+				b.Publish(fmt.Sprintf("p%d", p), fmt.Sprint(i))
+			}
+		}(p)
+	}
+	for _, ch := range receivers {
+		next := make(map[string]int)
+		for i := 0; i < publishers*each; i++ {
+			n := recv(t, ch)
+			if want := fmt.Sprint(next[n.Name]); n.Msg != want {
+				t.Fatalf("got %s from %s, want %s", n.Msg, n.Name, want)
+			}
+			next[n.Name]++
+		}
+	}
+}
+
+func TestDeliveryWorkersSlowClient(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeliveryWorkers = true
+	b := startBoard(cfg)
+	slow := make(chan *Notification)
+	fast := make(chan *Notification)
+	b.Login("slow", slow)
+	b.Login("fast", fast)
+
+	// Nobody reads slow, yet fast gets everything.
+	for _, msg := range []string{"one", "two", "three"} {
+		b.Publish("alice", msg)
+		if n := recv(t, fast); n.Msg != msg {
+			t.Fatalf("fast got %+v, want %s", n, msg)
+		}
+	}
+	// Logout waits for slow's queue to drain, in order.
+	got := make(chan []string)
+	go func() {
+		var msgs []string
+		for n := range slow {
+			msgs = append(msgs, n.Msg)
+		}
+		got <- msgs
+	}()
+	b.Logout("slow")
+	close(slow)
+	if msgs := <-got; fmt.Sprint(msgs) != "[one two three]" {
+		t.Errorf("slow got %v", msgs)
+	}
+}
+
+func BenchmarkFanout(bb *testing.B) {
+	for _, tc := range []struct {
+		name    string
+		workers bool
+		// stall is how long one of the clients takes over each message.
+		stall time.Duration
+	}{
+		{"direct", false, 0},
+		{"workers", true, 0},
+		{"direct-slow", false, 20 * time.Microsecond},
+		{"workers-slow", true, 20 * time.Microsecond},
+	} {
+		bb.Run(tc.name, func(bb *testing.B) {
+			cfg := DefaultConfig()
+			cfg.DeliveryWorkers = tc.workers
+			b := startBoard(cfg)
+			defer b.Close()
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				ch := make(chan *Notification)
+				b.Login(fmt.Sprintf("c%d", i), ch)
+				if i == 0 && tc.stall > 0 {
+					// Only the others are timed, to show how much
+					// one slow client holds them up.
+					go func() {
+						for n := 0; n < bb.N; n++ {
+							<-ch
+							time.Sleep(tc.stall)
+						}
+					}()
+					continue
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for n := 0; n < bb.N; n++ {
+						<-ch
+					}
+				}()
+			}
+			bb.ResetTimer()
+			for n := 0; n < bb.N; n++ {
+				b.Publish("sender", "hello")
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestProxyIdentity(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ProxyIdentity = true
+	b := startBoard(cfg)
+	alice := connect(t, b)
+	alice.send("IDENTITY alice")
+	// No prompt comes before the reply to /topic.
+	alice.quiet()
+	bob := connect(t, b)
+	bob.send("IDENTITY bob")
+	bob.quiet()
+	bob.send("hi")
+	alice.expect("bob: hi")
+
+	// The name cannot be chosen again, so a clash hangs up.
+	again := connect(t, b)
+	again.send("IDENTITY alice")
+	again.expect(ErrNameTaken.Error())
+	again.closed()
+
+	direct := connect(t, b)
+	direct.send("alice")
+	direct.expect("no identity from the proxy")
+	direct.closed()
+}
+
+func TestPriorityJumpsQueue(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeliveryWorkers = true
+	cfg.SendQueueSize = 2
+	b := startBoard(cfg)
+	b.Login("alice", make(chan *Notification, 10))
+	slow := make(chan *Notification)
+	b.Login("slow", slow)
+
+	// Nobody reads slow, so its queue fills and the rest is dropped.
+	for i := 0; i < 5; i++ {
+		b.Publish("bob", fmt.Sprint(i))
+	}
+	if err := b.SetTopic("alice", "news"); err != nil {
+		t.Fatal(err)
+	}
+	b.sync()
+	// At most the first message got past the queue before the topic
+	// change arrived.
+	var got []string
+	for len(got) < 2 {
+		n := recv(t, slow)
+		got = append(got, n.Msg)
+		if n.Type == NOTICE {
+			break
+		}
+	}
+	if last := got[len(got)-1]; last != "alice set the topic: news" {
+		t.Errorf("got %q before the notice", got)
+	}
+	if n := recv(t, slow); n.Type != TEXTLINE {
+		t.Errorf("got %+v after the notice", n)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration, 10)
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	cfg.FlushInterval = time.Second
+	b := startBoard(cfg)
+	alice := connect(t, b)
+	alice.expect("username> ")
+	alice.send("alice")
+	alice.send("/topic")
+	// The reply to /topic is the first thing written, which starts the wait
+	// for a flush.
+	if d := <-clock.started; d != time.Second {
+		t.Fatalf("flush after %s, want 1s", d)
+	}
+	b.Publish("bob", "one")
+	b.Publish("bob", "two")
+	b.sync()
+	select {
+	case line := <-alice.lines:
+		t.Fatalf("got %q before a flush was due", line)
+	default:
+	}
+	clock.Advance(time.Second)
+
+	// Everything written by the time a flush is due arrives then.
+	want := []string{"* no topic is set", "bob: one", "bob: two"}
+	for len(want) > 0 {
+		select {
+		case line := <-alice.lines:
+			if line != want[0] {
+				t.Fatalf("got %q, want %q", line, want[0])
+			}
+			want = want[1:]
+		case d := <-clock.started:
+			if d != time.Second {
+				t.Fatalf("flush after %s, want 1s", d)
+			}
+			clock.Advance(d)
+		case <-time.After(testTimeout):
+			t.Fatal("timed out waiting for a flush")
+		}
+	}
+}
+
+// countingConn counts the writes that reach the connection.
+type countingConn struct {
+	net.Conn
+	writes int64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt64(&c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func BenchmarkFlushInterval(bb *testing.B) {
+	for _, interval := range []time.Duration{0, 10 * time.Millisecond} {
+		bb.Run(fmt.Sprintf("interval-%s", interval), func(bb *testing.B) {
+			cfg := DefaultConfig()
+			cfg.FlushInterval = interval
+			b := startBoard(cfg)
+			defer b.Close()
+			srv, cli := net.Pipe()
+			defer cli.Close()
+			conn := &countingConn{Conn: srv}
+			go Serve(b, conn)
+			lines := bufio.NewScanner(cli)
+			prompt := make([]byte, len("username> "))
+			io.ReadFull(cli, prompt)
+			cli.Write([]byte("alice\n/topic\n"))
+			for lines.Scan() && lines.Text() != "* no topic is set" {
+			}
+			start := atomic.LoadInt64(&conn.writes)
+			done := make(chan struct{})
+			go func() {
+				for lines.Scan() && lines.Text() != "bob: done" {
+				}
+				close(done)
+			}()
+			bb.ResetTimer()
+			for i := 0; i < bb.N; i++ {
+				b.Publish("bob", "hello")
+			}
+			b.Publish("bob", "done")
+			<-done
+			bb.StopTimer()
+			bb.ReportMetric(float64(atomic.LoadInt64(&conn.writes)-start)/float64(bb.N), "writes/op")
+		})
+	}
+}
+
+func TestCloseEndsSessions(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	alice := dial(t, b, "alice")
+	bob := dial(t, b, "bob")
+	bob.send("bye")
+	alice.expect("bob: bye")
+
+	// Both are told and hung up on straight away, without either of them
+	// sending anything.
+	b.Close()
+	alice.expect("* room is closed")
+	alice.closed()
+	bob.expect("* room is closed")
+	bob.closed()
+}
+
+func TestNotRunning(t *testing.T) {
+	b := NewBoardWithConfig("test", DefaultConfig())
+	if err := b.Publish("bob", "hi"); err != ErrBoardNotStarted {
+		t.Errorf("publish before HandleBoard got %v", err)
+	}
+
+	go b.HandleBoard()
+	if err := b.Publish("bob", "hi"); err != nil {
+		t.Errorf("publish got %v", err)
+	}
+	b.Close()
+	if err := b.Publish("bob", "hi"); err != ErrBoardClosed {
+		t.Errorf("publish after Close got %v", err)
+	}
+	if err := b.Login("bob", make(chan *Notification, 10)); err != ErrBoardClosed {
+		t.Errorf("login after Close got %v", err)
+	}
+}
+
+func TestCloseUnresponsive(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration, 10)
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	// Nothing ever reads what is sent to dave.
+	if err := b.Login("dave", make(chan *Notification)); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		b.Close()
+		close(closed)
+	}()
+	clock.Advance(<-clock.started)
+	select {
+	case <-closed:
+	case <-time.After(testTimeout):
+		t.Fatal("Close is stuck on a client that is not reading")
+	}
+	alice.expect("* room is closed")
+	alice.closed()
+}
+
+func TestCloseAfterJoin(t *testing.T) {
+	boards := NewBoardRegistry(DefaultConfig())
+	defer boards.Close()
+	a := boards.GetOrCreate("a")
+	alice := dial(t, a, "alice")
+	alice.send("/join b")
+	alice.expect("* you are now in b")
+
+	// Closing the room alice left does not end the session there.
+	if err := boards.CloseRoom("a"); err != nil {
+		t.Fatal(err)
+	}
+	bob := dial(t, boards.Get("b"), "bob")
+	bob.send("hi")
+	alice.expect("bob: hi")
+}
+
+func TestConnMiddleware(t *testing.T) {
+	var in, out bytes.Buffer
+	cfg := DefaultConfig()
+	cfg.WrapReader = func(r io.Reader) io.Reader { return io.TeeReader(r, &in) }
+	cfg.WrapWriter = func(w io.Writer) io.Writer { return io.MultiWriter(&out, w) }
+	b := startBoard(cfg)
+	alice := dial(t, b, "alice")
+	alice.send("hello")
+	b.Publish("bob", "hi")
+	alice.expect("bob: hi")
+	alice.sync()
+
+	// Everything that crossed the wire went through the middleware.
+	if want := "alice\n/topic\nhello\n/topic\n"; in.String() != want {
+		t.Errorf("read %q, want %q", in.String(), want)
+	}
+	if want := "username> * no topic is set\nbob: hi\n* no topic is set\n"; out.String() != want {
+		t.Errorf("wrote %q, want %q", out.String(), want)
+	}
+}
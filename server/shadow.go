@@ -0,0 +1,49 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+// ShadowMute turns the shadow mute on name on or off, reporting whether it
+// is now on. A shadow-muted user's messages are accepted as usual, and they
+// see what they would see anyway, but nobody else is sent them and they are
+// not kept in the history. The mute lasts until name logs out. Only the room
+// admin may shadow mute.
+func (b *Board) ShadowMute(by, name string) (bool, error) {
+	var on bool
+	var err error
+	b.query(func() {
+		c := b.clients[name]
+		switch {
+		case b.admin != by:
+			err = ErrNotAdmin
+		case c == nil:
+			err = ErrNoSuchUser
+		default:
+			c.shadowMuted = !c.shadowMuted
+			on = c.shadowMuted
+			fmt.Printf("[%s] shadow mute on [%s]: %t\n", by, name, on)
+		}
+	})
+	return on, err
+}
+
+// shadowed reports whether name is shadow-muted.
+func (b *Board) shadowed(name string) bool {
+	c := b.clients[name]
+	return c != nil && c.shadowMuted
+}
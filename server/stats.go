@@ -0,0 +1,47 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// BoardStats is a view of who is on a board, taken whenever someone joins or
+// leaves. A BoardStats is never changed once published; do not modify
+// Members.
+type BoardStats struct {
+	// Members holds the names of the clients in sorted order.
+	Members []string
+	Count   int
+	// Unhealthy is set if the board goroutine did not answer the last
+	// Probe in time.
+	Unhealthy bool
+}
+
+// Stats returns the board's latest membership without waiting on the board
+// goroutine, so it is cheap enough to poll from metrics and health checks.
+// It is current as of the last login or logout the board has handled; a
+// Login that has returned is always included.
+func (b *Board) Stats() *BoardStats {
+	s := b.stats.Load().(*BoardStats)
+	if b.unhealthy.Load() {
+		flagged := *s
+		flagged.Unhealthy = true
+		return &flagged
+	}
+	return s
+}
+
+// publishStats replaces the stats. Runs on the board goroutine.
+func (b *Board) publishStats() {
+	members := sortedNames(b.clients)
+	b.stats.Store(&BoardStats{Members: members, Count: len(members)})
+}
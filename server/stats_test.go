@@ -0,0 +1,116 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	if s := b.Stats(); s.Count != 0 || len(s.Members) != 0 {
+		t.Errorf("new board: %+v", s)
+	}
+	b.Login("bob", make(chan *Notification, 10))
+	b.Login("alice", make(chan *Notification, 10))
+	// No round trip needed: Login returns after the board has published.
+	if s := b.Stats(); s.Count != 2 || !reflect.DeepEqual(s.Members, []string{"alice", "bob"}) {
+		t.Errorf("after logins: %+v", s)
+	}
+	b.Logout("bob")
+	b.sync()
+	if s := b.Stats(); s.Count != 1 || !reflect.DeepEqual(s.Members, []string{"alice"}) {
+		t.Errorf("after logout: %+v", s)
+	}
+}
+
+func TestStatsConcurrentReads(t *testing.T) {
+	b := startBoard(DefaultConfig())
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if s := b.Stats(); s.Count != len(s.Members) {
+					t.Errorf("inconsistent stats %+v", s)
+					return
+				}
+			}
+		}()
+	}
+	for _, name := range []string{"alice", "bob", "carol", "dave"} {
+		b.Login(name, make(chan *Notification, 10))
+		b.Logout(name)
+	}
+	b.sync()
+	close(stop)
+	wg.Wait()
+	if s := b.Stats(); s.Count != 0 {
+		t.Errorf("after everyone left: %+v", s)
+	}
+}
+
+func TestProbe(t *testing.T) {
+	clock := newFakeClock()
+	clock.started = make(chan time.Duration, 10)
+	cfg := DefaultConfig()
+	cfg.Clock = clock
+	b := startBoard(cfg)
+	if !b.Probe(time.Second) {
+		t.Fatal("a running board failed the probe")
+	}
+	<-clock.started
+	if s := b.Stats(); s.Unhealthy {
+		t.Errorf("healthy board: %+v", s)
+	}
+
+	// Wedge the board goroutine until the probe has timed out.
+	stuck := make(chan struct{})
+	b.post(&Notification{Type: QUERY, fn: func() { <-stuck }})
+	answered := make(chan bool)
+	go func() { answered <- b.Probe(time.Second) }()
+	clock.Advance(<-clock.started)
+	if <-answered {
+		t.Fatal("a stuck board passed the probe")
+	}
+	if s := b.Stats(); !s.Unhealthy {
+		t.Errorf("stuck board: %+v", s)
+	}
+
+	// It recovers once the board is answering again.
+	close(stuck)
+	if !b.Probe(time.Second) {
+		t.Fatal("the board failed the probe after it came unstuck")
+	}
+	<-clock.started
+	if s := b.Stats(); s.Unhealthy {
+		t.Errorf("recovered board: %+v", s)
+	}
+
+	b.Close()
+	if b.Probe(time.Second) {
+		t.Error("a closed board passed the probe")
+	}
+}
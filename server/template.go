@@ -0,0 +1,54 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// parseMessageTemplate parses a MessageTemplate. An empty one is nil, for the
+// usual "name: text".
+func parseMessageTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	t, err := template.New("message").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("bad message template: %s", err)
+	}
+	return t, nil
+}
+
+// boardTemplate parses b's MessageTemplate. Config files are checked as they
+// are loaded, so a bad one here was set in code; it is reported and the
+// board renders messages as usual.
+func boardTemplate(name string, cfg BoardConfig) *template.Template {
+	t, err := parseMessageTemplate(cfg.MessageTemplate)
+	if err != nil {
+		fmt.Printf("board [%s]: %s\n", name, err)
+	}
+	return t
+}
+
+// execute renders n with t, reporting false if the template fails on it.
+func execute(t *template.Template, n *Notification) (string, bool) {
+	var out strings.Builder
+	if err := t.Execute(&out, n); err != nil {
+		return "", false
+	}
+	return out.String(), true
+}
@@ -0,0 +1,91 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"time"
+)
+
+// throttle is what a user throttled by slow mode or flood protection has
+// been told, with a ThrottleNoticeWindow.
+type throttle struct {
+	// told is when they were last told a message was dropped.
+	told time.Time
+	// until is when they can send again.
+	until time.Time
+}
+
+// throttled tells name why a message of theirs was dropped; they can send
+// again at until. With a ThrottleNoticeWindow they are told at most once per
+// window, and once more when they can send again. Runs on the board
+// goroutine, as do the rest.
+func (b *Board) throttled(name, why string, until time.Time) {
+	if b.cfg.ThrottleNoticeWindow <= 0 {
+		b.tell(name, why)
+		return
+	}
+	now := b.cfg.clock().Now()
+	t := b.throttle(name, until)
+	if t.told.IsZero() || now.Sub(t.told) >= b.cfg.ThrottleNoticeWindow {
+		b.tell(name, why)
+		t.told = now
+	}
+}
+
+// throttle returns what name has been told, noting that they cannot send
+// until then.
+func (b *Board) throttle(name string, until time.Time) *throttle {
+	if b.throttles == nil {
+		b.throttles = make(map[string]*throttle)
+	}
+	t := b.throttles[name]
+	if t == nil {
+		t = &throttle{}
+		b.throttles[name] = t
+	}
+	if until.After(t.until) {
+		t.until = until
+	}
+	if b.throttleTimer != nil && until.Before(b.throttleAt) {
+		// A short wait, for slow mode say, behind a long flood mute.
+		b.throttleTimer.Stop()
+		b.throttleTimer = nil
+	}
+	if b.throttleTimer == nil {
+		b.throttleTimer = b.cfg.clock().NewTimer(until.Sub(b.cfg.clock().Now()))
+		b.throttleAt = until
+	}
+	return t
+}
+
+// resume tells everyone whose throttling is over that they can send again,
+// and waits for the next one, if any.
+func (b *Board) resume() {
+	b.throttleTimer = nil
+	now := b.cfg.clock().Now()
+	var next time.Time
+	for name, t := range b.throttles {
+		if !t.until.After(now) {
+			delete(b.throttles, name)
+			b.tell(name, "you can send again")
+		} else if next.IsZero() || t.until.Before(next) {
+			next = t.until
+		}
+	}
+	if !next.IsZero() {
+		b.throttleTimer = b.cfg.clock().NewTimer(next.Sub(now))
+		b.throttleAt = next
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// transcriptEntry is one message of a JSON transcript.
+type transcriptEntry struct {
+	Seq    uint64 `json:"seq"`
+	Time   string `json:"time"`
+	Name   string `json:"name"`
+	Text   string `json:"text"`
+	Parent uint64 `json:"parent,omitempty"`
+}
+
+// WriteTranscript writes the board's history to w, oldest first, in format
+// "plain", as lines of "2006-01-02T15:04:05Z alice: hello", or "json", as
+// one JSON object per line.
+func (b *Board) WriteTranscript(w io.Writer, format string) error {
+	if format != "plain" && format != "json" {
+		return fmt.Errorf("unknown transcript format %q, try plain or json", format)
+	}
+	bw := bufio.NewWriter(w)
+	for _, m := range b.Snapshot().History {
+		when := m.Time.UTC().Format(time.RFC3339)
+		if format == "plain" {
+			fmt.Fprintf(bw, "%s %s: %s\n", when, m.Name, m.Msg)
+			continue
+		}
+		data, err := json.Marshal(transcriptEntry{
+			Seq:    m.Seq,
+			Time:   when,
+			Name:   m.Name,
+			Text:   m.Msg,
+			Parent: m.Parent,
+		})
+		if err != nil {
+			return err
+		}
+		bw.Write(append(data, '\n'))
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,58 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+)
+
+// Version is the server version reported by /version. Release builds set it
+// with -ldflags "-X github.com/drzaeus77/go-chat-simple/server.Version=...".
+var Version = "dev"
+
+// features lists the optional features that b's configuration turns on, for
+// clients to adapt to.
+func (b *Board) features() []string {
+	cfg := &b.cfg
+	var f []string
+	for _, feature := range []struct {
+		name string
+		on   bool
+	}{
+		{"history", cfg.HistorySize > 0},
+		{"acks", cfg.Ack != AckNone},
+		{"anonymous", cfg.AllowAnonymous},
+		{"fragments", cfg.FragmentSize > 0},
+		{"slowmode", cfg.SlowMode > 0},
+		{"flood", cfg.FloodMessages > 0},
+		{"rooms", b.rooms != nil},
+		{"compression", cfg.Compression},
+		{"federation", len(cfg.FederationSecret) > 0},
+	} {
+		if feature.on {
+			f = append(f, feature.name)
+		}
+	}
+	return f
+}
+
+// versionNotice is the answer to /version.
+func (b *Board) versionNotice() string {
+	f := b.features()
+	if len(f) == 0 {
+		return "go-chat-simple " + Version + ", no optional features"
+	}
+	return "go-chat-simple " + Version + ", features: " + strings.Join(f, " ")
+}
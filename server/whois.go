@@ -0,0 +1,132 @@
+// Copyright 2017 Brenden Blanco
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// origin says where a client is connected from.
+type origin struct {
+	addr string
+	// since is when the connection was made.
+	since time.Time
+	// hangup closes the connection.
+	hangup func()
+}
+
+// ClientInfo describes a logged in client, for /whois and Sessions.
+type ClientInfo struct {
+	Name string
+	// Addr and Connected are where the client's connection comes from and
+	// when it was made. Both are empty for an in-process client.
+	Addr      string
+	Connected time.Time
+	// Sent counts the messages the client has published in Room.
+	Sent int
+	Room string
+	Role Role
+	// Idle is how long since the client last published anything, or since
+	// it came into the room if it has not.
+	Idle time.Duration
+}
+
+// String formats info as a single line.
+func (info ClientInfo) String() string {
+	from := "in-process"
+	if info.Addr != "" {
+		from = fmt.Sprintf("from %s since %s", info.Addr, info.Connected.Format("2006-01-02 15:04:05"))
+	}
+	return fmt.Sprintf("%s: %s, %d messages sent, in room %s, %s, idle %s",
+		info.Name, from, info.Sent, info.Room, info.Role, info.Idle.Truncate(time.Second))
+}
+
+// Whois returns what the board knows about name's client. Only the room
+// admin may ask.
+func (b *Board) Whois(by, name string) (ClientInfo, error) {
+	var info ClientInfo
+	var err error
+	b.query(func() {
+		c := b.clients[name]
+		switch {
+		case b.admin != by:
+			err = ErrNotAdmin
+			return
+		case c == nil:
+			err = ErrNoSuchUser
+			return
+		}
+		info = b.clientInfo(name, c, b.cfg.clock().Now())
+	})
+	return info, err
+}
+
+// Clients describes every client on the board, sorted by name.
+func (b *Board) Clients() []ClientInfo {
+	var infos []ClientInfo
+	b.query(func() {
+		now := b.cfg.clock().Now()
+		for _, name := range sortedNames(b.clients) {
+			infos = append(infos, b.clientInfo(name, b.clients[name], now))
+		}
+	})
+	return infos
+}
+
+// ForEachClient calls fn with the name of every client on the board, sorted
+// by name. fn runs on the board goroutine, so the clients it is shown are
+// those of one moment, with nobody coming or going in between; for the same
+// reason it must not call the board's methods, which would wait on fn.
+func (b *Board) ForEachClient(fn func(name string)) {
+	b.query(func() {
+		for _, name := range sortedNames(b.clients) {
+			fn(name)
+		}
+	})
+}
+
+// clientInfo describes the client c logged in as name, as of now.
+func (b *Board) clientInfo(name string, c *client, now time.Time) ClientInfo {
+	info := ClientInfo{
+		Name: name,
+		Sent: c.sent,
+		Room: b.Name,
+		Role: b.roleOf(name, c),
+	}
+	if c.from != nil {
+		info.Addr, info.Connected = c.from.addr, c.from.since
+	}
+	active := b.lastPresence[name]
+	if said, ok := b.lastMessage[name]; ok && said.After(active) {
+		active = said
+	}
+	info.Idle = now.Sub(active)
+	return info
+}
+
+// Sessions describes every client logged in to any of the registry's
+// boards, sorted by room and then by name. A name logged in to several rooms
+// appears once for each. Each board is asked in turn, so a client moving
+// between rooms meanwhile may be missed or counted twice.
+func (r *BoardRegistry) Sessions() []ClientInfo {
+	var infos []ClientInfo
+	for _, room := range r.Names() {
+		if b := r.Get(room); b != nil {
+			infos = append(infos, b.Clients()...)
+		}
+	}
+	return infos
+}